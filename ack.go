@@ -0,0 +1,125 @@
+package clacks
+
+import "time"
+
+const (
+	ackBatchSize = 32                    // acks sent together at most
+	ackDelay     = 20 * time.Millisecond // time an ack waits for others
+)
+
+// PushAckFunc is called once for each push sent while acknowledgements are
+// enabled. Acked is true if the client confirmed the push and false if it
+// expired or the connection was lost before the client confirmed it.
+type PushAckFunc func(clientId uint64, pushSeq uint64, value interface{}, acked bool)
+
+type unackedPush struct {
+	value interface{}
+	timer *time.Timer
+}
+
+// SetPushAcks makes the clients acknowledge the pushes they receive. Each push
+// gets a per-connection sequence number and is kept until the client confirms
+// it or the timeout passes. Then cb is called with the outcome. A timeout of
+// 0, the default, disables acknowledgements.
+func (server *Server) SetPushAcks(timeout time.Duration, cb PushAckFunc) {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	server.ackTimeout = timeout
+	server.ackCB = cb
+}
+
+//Keep a push until it is acknowledged and return its sequence. Returns 0 if
+//acknowledgements are disabled
+func (conn *connection) retainPush(value interface{}) uint64 {
+	conn.server.lock.Lock()
+	timeout := conn.server.ackTimeout
+	conn.server.lock.Unlock()
+	if timeout <= 0 {
+		return 0
+	}
+	conn.pushLock.Lock()
+	defer conn.pushLock.Unlock()
+	if conn.unacked == nil {
+		conn.unacked = make(map[uint64]*unackedPush)
+	}
+	conn.pushSeq++
+	seq := conn.pushSeq
+	conn.unacked[seq] = &unackedPush{
+		value: value,
+		timer: time.AfterFunc(timeout, func() { conn.settlePush(seq, false) }),
+	}
+	return seq
+}
+
+//Forget a push and tell the server callback if it was delivered
+func (conn *connection) settlePush(seq uint64, acked bool) {
+	conn.pushLock.Lock()
+	push, present := conn.unacked[seq]
+	delete(conn.unacked, seq)
+	conn.pushLock.Unlock()
+	if !present {
+		return
+	}
+	push.timer.Stop()
+	conn.server.lock.Lock()
+	cb := conn.server.ackCB
+	clientId := conn.id
+	conn.server.lock.Unlock()
+	if cb != nil {
+		cb(clientId, seq, push.value, acked)
+	}
+}
+
+//Fail all the pushes that have not been acknowledged yet
+func (conn *connection) expirePushes() {
+	conn.pushLock.Lock()
+	seqs := make([]uint64, 0, len(conn.unacked))
+	for seq := range conn.unacked {
+		seqs = append(seqs, seq)
+	}
+	conn.pushLock.Unlock()
+	for _, seq := range seqs {
+		conn.settlePush(seq, false)
+	}
+}
+
+//Read the sequences acknowledged by a R_ACK request
+func (conn *connection) processAck(req *Request) error {
+	var seqs []uint64
+	if err := conn.codec.ReadBody(&seqs); err != nil {
+		return err
+	}
+	for _, seq := range seqs {
+		conn.settlePush(seq, true)
+	}
+	return nil
+}
+
+//Acknowledge a push. Acks are sent in batches
+func (client *Client) ackPush(seq uint64) {
+	client.ackLock.Lock()
+	defer client.ackLock.Unlock()
+	client.acks = append(client.acks, seq)
+	if len(client.acks) >= ackBatchSize {
+		go client.flushAcks()
+	} else if client.ackTimer == nil {
+		client.ackTimer = time.AfterFunc(ackDelay, client.flushAcks)
+	}
+}
+
+//Send the pending acks
+func (client *Client) flushAcks() {
+	client.ackLock.Lock()
+	seqs := client.acks
+	client.acks = nil
+	if client.ackTimer != nil {
+		client.ackTimer.Stop()
+		client.ackTimer = nil
+	}
+	client.ackLock.Unlock()
+	if len(seqs) == 0 {
+		return
+	}
+	//If it fails the connection is gone and the server expires the pushes
+	client.codec.WriteRequest(&Request{Type: R_ACK}, seqs)
+}
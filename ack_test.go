@@ -0,0 +1,82 @@
+package clacks
+
+import (
+	"testing"
+	"time"
+)
+
+type ackResult struct {
+	clientId uint64
+	seq      uint64
+	value    interface{}
+	acked    bool
+}
+
+func TestPushAck(t *testing.T) {
+	srv, addr := startAcceptServer(t, new(PushService))
+	results := make(chan ackResult, 10)
+	srv.SetPushAcks(time.Second, func(clientId, seq uint64, value interface{}, acked bool) {
+		results <- ackResult{clientId, seq, value, acked}
+	})
+	client, err := Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("dialing", err)
+	}
+	defer client.Close()
+	if err := client.SubscribeToPush(func(pd PushData) {}); err != nil {
+		t.Fatal(err)
+	}
+	ci := new(ClientInfo)
+	if err := client.Call("PushService.WhoAmI", ci); err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 2; i++ {
+		if err := client.Call("PushService.PushMe", Args{i, i}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 1; i <= 2; i++ {
+		select {
+		case res := <-results:
+			if !res.acked || res.clientId != ci.Id {
+				t.Error("Push was not acknowledged", res)
+			}
+			if pd := res.value.(PushData); res.seq != uint64(pd.A) {
+				t.Error("Push sequence", res.seq, "does not match value", pd)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("Push was neither acknowledged nor expired")
+		}
+	}
+}
+
+func TestPushAckExpire(t *testing.T) {
+	srv := NewServer()
+	results := make(chan ackResult, 10)
+	srv.SetPushAcks(50*time.Millisecond, func(clientId, seq uint64, value interface{}, acked bool) {
+		results <- ackResult{clientId, seq, value, acked}
+	})
+	conn := newConnection(srv, 5, NewContext(), nil, nil)
+	if seq := conn.retainPush("expires"); seq != 1 {
+		t.Fatal("Expected sequence 1 and got", seq)
+	}
+	conn.retainPush("acked")
+	conn.settlePush(2, true)
+	conn.settlePush(2, false)
+	if res := <-results; !res.acked || res.seq != 2 || res.value != "acked" {
+		t.Error("Unexpected result for acknowledged push", res)
+	}
+	select {
+	case res := <-results:
+		if res.acked || res.seq != 1 || res.clientId != 5 || res.value != "expires" {
+			t.Error("Unexpected result for expired push", res)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Push did not expire")
+	}
+	select {
+	case res := <-results:
+		t.Error("Push was settled twice", res)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
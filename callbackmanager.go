@@ -11,6 +11,7 @@ import (
 type callback struct {
 	method reflect.Value
 	mid    uint64
+	topic  string //Only receive pushes for this topic. Empty means any
 }
 
 type CallbackId struct {
@@ -26,6 +27,11 @@ type CallbackManager struct {
 
 //Subscribe to pushed messages from the server
 func (cbmgr *CallbackManager) Subscribe(cb interface{}) (CallbackId, error) {
+	return cbmgr.SubscribeToTopic("", cb)
+}
+
+//Subscribe to pushed messages from the server that were published to a topic
+func (cbmgr *CallbackManager) SubscribeToTopic(topic string, cb interface{}) (CallbackId, error) {
 	cbmgr.lock.Lock()
 	defer cbmgr.lock.Unlock()
 	sid := CallbackId{}
@@ -39,7 +45,7 @@ func (cbmgr *CallbackManager) Subscribe(cb interface{}) (CallbackId, error) {
 	}
 	arg := mtype.In(0)
 	if arg.Kind() == reflect.Ptr {
-		return sid, errors.New(fmt.Sprintf("%v cannot receive a pointer"))
+		return sid, errors.New(fmt.Sprintf("%v cannot receive a pointer", cb))
 	}
 	if cbmgr.pushMap == nil {
 		cbmgr.pushMap = make(map[string][]*callback)
@@ -47,6 +53,7 @@ func (cbmgr *CallbackManager) Subscribe(cb interface{}) (CallbackId, error) {
 	argName := arg.String()
 	ps := new(callback)
 	ps.method = mval
+	ps.topic = topic
 	ps.mid = cbmgr.midCounter
 	cbmgr.midCounter++
 	sid.mid = ps.mid
@@ -78,28 +85,73 @@ func (cbmgr *CallbackManager) Unsubscribe(sid CallbackId) {
 	}
 }
 
+//Unsubscribe all the callbacks for a topic
+func (cbmgr *CallbackManager) UnsubscribeTopic(topic string) {
+	cbmgr.lock.Lock()
+	defer cbmgr.lock.Unlock()
+	for argName, subs := range cbmgr.pushMap {
+		kept := subs[:0]
+		for _, sub := range subs {
+			if sub.topic != topic {
+				kept = append(kept, sub)
+			}
+		}
+		cbmgr.pushMap[argName] = kept
+	}
+}
+
+//Get the topics that have at least one callback
+func (cbmgr *CallbackManager) topics() []string {
+	cbmgr.lock.RLock()
+	defer cbmgr.lock.RUnlock()
+	found := make(map[string]bool)
+	topics := make([]string, 0)
+	for _, subs := range cbmgr.pushMap {
+		for _, sub := range subs {
+			if sub.topic != "" && !found[sub.topic] {
+				found[sub.topic] = true
+				topics = append(topics, sub.topic)
+			}
+		}
+	}
+	return topics
+}
+
+//Get the types received by the subscribed callbacks
+func (cbmgr *CallbackManager) argTypes() []reflect.Type {
+	cbmgr.lock.RLock()
+	defer cbmgr.lock.RUnlock()
+	types := make([]reflect.Type, 0, len(cbmgr.pushMap))
+	for _, subs := range cbmgr.pushMap {
+		if len(subs) > 0 {
+			types = append(types, subs[0].method.Type().In(0))
+		}
+	}
+	return types
+}
+
 //Execute all subscribed functions to a push message
 func (cbmgr *CallbackManager) SendToAll(arg interface{}) {
+	cbmgr.SendToTopic("", arg)
+}
+
+//Execute all subscribed functions to a push message published to a topic.
+//Functions subscribed without a topic receive all the messages.
+func (cbmgr *CallbackManager) SendToTopic(topic string, arg interface{}) {
 	cbmgr.lock.RLock()
 	defer cbmgr.lock.RUnlock()
-	argType := reflect.TypeOf(arg)
-	typeName := argType.String()
-	isPointer := argType.Kind() == reflect.Ptr
-	if isPointer {
-		typeName = argType.Elem().String()
+	//Callbacks always receive values so dereference any pointer received
+	argVal := reflect.ValueOf(arg)
+	for argVal.Kind() == reflect.Ptr && !argVal.IsNil() {
+		argVal = argVal.Elem()
 	}
+	typeName := argVal.Type().String()
 	if subs, ok := cbmgr.pushMap[typeName]; ok {
-		argVal := reflect.ValueOf(arg)
 		for _, sub := range subs {
-			var args []reflect.Value
-			switch {
-			case !isPointer:
-				//Same received and expeted types
-				args = []reflect.Value{argVal}
-			case isPointer:
-				//Received is pointer and expected is value
-				args = []reflect.Value{argVal.Elem()}
+			if sub.topic != "" && sub.topic != topic {
+				continue
 			}
+			args := []reflect.Value{argVal}
 			//Execute the push in a goroutine
 			go func(sub *callback, args []reflect.Value) {
 				sub.method.Call(args)
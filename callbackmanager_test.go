@@ -107,3 +107,32 @@ func TestPushCB(t *testing.T) {
 		t.Error("Something didn't go as expected")
 	}
 }
+
+func TestTopicCB(t *testing.T) {
+	cbmgr := new(CallbackManager)
+	s := new(Subs)
+	s.WG = new(sync.WaitGroup)
+	if _, err := cbmgr.SubscribeToTopic("a", s.doSomething); err != nil {
+		t.Error(err)
+	}
+	if _, err := cbmgr.SubscribeToTopic("b", s.doSomething2); err != nil {
+		t.Error(err)
+	}
+	s.WG.Add(1)
+	cbmgr.SendToTopic("a", PushData{1, 2})
+	s.WG.Wait()
+	if s.Total != 3 || s.Count != 1 {
+		t.Error("Topic filter didn't work")
+	}
+	cbmgr.UnsubscribeTopic("a")
+	if subs := cbmgr.pushMap["clacks.PushData"]; len(subs) != 1 || subs[0].topic != "b" {
+		t.Error("Did not unsubscribe the topic")
+	}
+	cbmgr.SendToTopic("a", PushData{1, 2})
+	s.WG.Add(1)
+	cbmgr.SendToTopic("b", PushData{1, 2})
+	s.WG.Wait()
+	if s.Total != 6 || s.Count != 2 {
+		t.Error("Topic filter didn't work")
+	}
+}
@@ -2,6 +2,7 @@ package clacks
 
 import (
 	"bufio"
+	"crypto/tls"
 	"errors"
 	"io"
 	"log"
@@ -10,10 +11,12 @@ import (
 	"reflect"
 	"strconv"
 	"sync"
+	"time"
 )
 
 // ServerError represents an error that has been returned from
-// the remote side of the RPC connection.
+// the remote side of the RPC connection. Errors sent with a code arrive as
+// an *Error that wraps it.
 type ServerError string
 
 func (e ServerError) Error() string {
@@ -23,8 +26,11 @@ func (e ServerError) Error() string {
 var ErrShutdown = errors.New("connection is shut down")
 
 type Client struct {
-	codec Codec
-	cbmgr *CallbackManager
+	codec    Codec
+	cbmgr    *CallbackManager
+	ctx      *Context  // context for the methods called by the server
+	registry *Registry // methods that the server can call
+	types    *TypeTable
 
 	sending sync.Mutex
 
@@ -34,16 +40,36 @@ type Client struct {
 	pending  map[uint64]*Call
 	closing  bool // user has called Close
 	shutdown bool // server has told us to stop
+	// wrap the calls and the pushes
+	interceptors     []ClientInterceptor
+	pushInterceptors []PushInterceptor
+
+	disconnected chan struct{} // closed once the connection is lost
+
+	ackLock  sync.Mutex // protects following
+	acks     []uint64   // pushes to acknowledge
+	ackTimer *time.Timer
 }
 
 type Call struct {
-	Method string        // The name of the service and method to call.
-	Args   []interface{} // The argument to the function (*struct).
-	Error  error         // After completion, the error status.
-	Done   chan *Call    // Strobes when call is complete.
+	Method  string        // The name of the service and method to call.
+	Args    []interface{} // The argument to the function (*struct).
+	Error   error         // After completion, the error status.
+	Results []interface{} // After completion, the values the method returned.
+	Done    chan *Call    // Strobes when call is complete.
+	stream  *ClientStream // Receives R_DATA values for streaming calls
+	seq     uint64
+	reqType uint8 // Type of the request. R_RPC unless set
+
+	// Metadata sent with the call. Interceptors can add to it and the
+	// server reads it with Context.GetMetadata.
+	Metadata map[string]string
 }
 
-type disconnectType *Client
+//Callbacks can not receive pointers so the client is wrapped in a struct
+type disconnectType struct {
+	client *Client
+}
 
 func (call *Call) done() {
 	select {
@@ -59,8 +85,20 @@ func (call *Call) done() {
 }
 
 func (client *Client) readResponseBody(call *Call) error {
+	return readReplyBody(client.codec, call)
+}
+
+//Read the reply of a call and copy the values into its pointer arguments.
+//What is left are the values returned by the method
+func readReplyBody(codec Codec, call *Call) error {
+	//Codecs that do not carry types, like JSON, decode into the pointers
 	ifaces := make([]interface{}, 0)
-	err := client.codec.ReadBody(&ifaces)
+	for _, arg := range call.Args {
+		if reflect.ValueOf(arg).Kind() == reflect.Ptr {
+			ifaces = append(ifaces, arg)
+		}
+	}
+	err := codec.ReadBody(&ifaces)
 	if err != nil {
 		return err
 	}
@@ -70,16 +108,25 @@ func (client *Client) readResponseBody(call *Call) error {
 			if replyPos >= len(ifaces) {
 				return errors.New("Return data did not include all pointer values")
 			}
+			//Registered types arrive as **Type and builtin ones as Type
+			argVal := reflect.ValueOf(arg).Elem()
 			rplVal := reflect.ValueOf(ifaces[replyPos])
-			if rplVal.Kind() != reflect.Ptr || rplVal.Elem().Kind() != reflect.Ptr {
-				return errors.New("Return position " + strconv.Itoa(replyPos) + " is not a **Type")
+			for rplVal.IsValid() && rplVal.Type() != argVal.Type() && rplVal.Kind() == reflect.Ptr {
+				rplVal = rplVal.Elem()
+			}
+			if !rplVal.IsValid() || rplVal.Type() != argVal.Type() {
+				return errors.New("Return position " + strconv.Itoa(replyPos) + " is not a " + argVal.Type().String())
 			}
 			replyPos++
-			reflect.ValueOf(arg).Elem().Set(rplVal.Elem().Elem())
+			argVal.Set(rplVal)
 		}
 	}
+	//The rest are the values returned by the method
 	if replyPos < len(ifaces) {
-		return errors.New("Return data has more pointer values than expected")
+		call.Results = make([]interface{}, len(ifaces)-replyPos)
+		for iPos, result := range ifaces[replyPos:] {
+			call.Results[iPos] = indirectValue(result)
+		}
 	}
 	return err
 }
@@ -98,13 +145,16 @@ func (client *Client) processRPCResponse(response Response) (err error) {
 		// removed; response is a server telling us about an
 		// error reading request body
 		if response.Error != "" {
+			if response.HasDetail {
+				client.codec.ReadBody(nil)
+			}
 			err = errors.New(response.Error)
 		}
 	case response.Error != "":
 		// We've got an error response. Give this to the request;
 		// any subsequent requests will get the ReadResponseBody
 		// error if there is one.
-		call.Error = ServerError(response.Error)
+		call.Error = client.readError(response)
 		call.done()
 	default:
 		err = client.readResponseBody(call)
@@ -116,11 +166,37 @@ func (client *Client) processRPCResponse(response Response) (err error) {
 	return
 }
 
+//Rebuild the error of a call. Errors sent without a code are ServerErrors
+func (client *Client) readError(response Response) error {
+	if response.Code == "" {
+		return ServerError(response.Error)
+	}
+	err := &Error{
+		Code:      ErrorCode(response.Code),
+		Message:   response.Error,
+		Retryable: response.Retryable,
+		cause:     remoteCauses(response.Causes),
+		remote:    true,
+	}
+	if response.HasDetail {
+		//Details of types that are not registered are left out
+		var detail interface{}
+		if client.codec.ReadBody(&detail) == nil {
+			err.Detail = indirectValue(detail)
+		}
+	}
+	return err
+}
+
 func (client *Client) processPushResponse(response Response) (err error) {
 	var data interface{}
 	err = client.codec.ReadBody(&data)
-	if err != nil {
-		client.cbmgr.SendToAll(data)
+	if err == nil && data != nil {
+		//Interceptors get values like the callbacks do
+		client.interceptPush(client.cbmgr.SendToTopic)(response.Topic, indirectValue(data))
+	}
+	if err == nil && response.PushSeq != 0 {
+		client.ackPush(response.PushSeq)
 	}
 	return
 }
@@ -139,9 +215,18 @@ func (client *Client) processInput() {
 			err = client.processRPCResponse(response)
 		case R_PUSH:
 			err = client.processPushResponse(response)
+		case R_CLOSE:
+			err = ServerError("Disconnected by server: " + response.Error)
+		case R_CALL:
+			err = client.processCall(response)
+		case R_DATA:
+			err = client.processDataResponse(response)
 		}
 
 	}
+	if _, ok := err.(ProtocolError); ok {
+		client.codec.Close()
+	}
 	// Terminate pending calls.
 	client.sending.Lock()
 	client.mutex.Lock()
@@ -160,14 +245,75 @@ func (client *Client) processInput() {
 	}
 	client.mutex.Unlock()
 	client.sending.Unlock()
-	var disc disconnectType
-	disc = client
-	client.cbmgr.SendToAll(disc)
+	close(client.disconnected)
+	client.cbmgr.SendToAll(disconnectType{client})
 	//if debugLog && err != io.EOF && !closing {
 	//	log.Println("rpc: client protocol error:", err)
 	//}
 }
 
+//Execute a method requested by the server and send back the reply
+func (client *Client) processCall(response Response) error {
+	client.mutex.Lock()
+	registry := client.registry
+	client.mutex.Unlock()
+	var svc *serviceData
+	var mData *methodData
+	var args []reflect.Value
+	err := errors.New("Client has no registered services")
+	if registry != nil {
+		svc, mData, err = registry.lookup(response.Method)
+	}
+	if err == nil && (mData.stream || mData.recvStream) {
+		err = errors.New("Streaming methods can not be called on clients")
+	}
+	if err != nil {
+		client.codec.ReadBody(nil)
+		return client.sendReply(response.Seq, err.Error(), nil)
+	}
+	args, err = readArguments(client.codec, mData)
+	if err != nil {
+		return client.sendReply(response.Seq, err.Error(), nil)
+	}
+	go svc.ExecuteMethod(mData, client.ctx, args, func(rargs []reflect.Value, errMsg string) {
+		if err := client.sendReply(response.Seq, errMsg, rargs); err != nil {
+			log.Println("writing reply:", err)
+		}
+	})
+	return nil
+}
+
+func (client *Client) sendReply(seq uint64, errMsg string, rargs []reflect.Value) error {
+	req := &Request{Type: R_REPLY, Seq: seq, Error: errMsg}
+	if len(errMsg) > 0 {
+		return client.codec.WriteRequest(req, nil)
+	}
+	return client.codec.WriteRequest(req, valuesToInterfaces(rargs))
+}
+
+// Register publishes the methods of rcvr so that the server can call them
+// with Context.CallClient. The same rules as for server services apply.
+func (client *Client) Register(rcvr interface{}) error {
+	client.mutex.Lock()
+	if client.registry == nil {
+		client.registry = &Registry{types: client.types}
+	}
+	registry := client.registry
+	client.mutex.Unlock()
+	return registry.Register(rcvr)
+}
+
+//Tell if a call failed because the connection was lost
+func (client *Client) lostConnection(err error) bool {
+	var serverErr ServerError
+	if errors.As(err, &serverErr) {
+		return false
+	}
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	return client.shutdown
+}
+
 func (client *Client) Close() error {
 	client.mutex.Lock()
 	if client.closing {
@@ -181,16 +327,52 @@ func (client *Client) Close() error {
 
 func (client *Client) SubscribeToDisconnect(cb func(*Client)) error {
 	_, err := client.cbmgr.Subscribe(func(disc disconnectType) {
-		cb(disc)
+		cb(disc.client)
 	})
 	return err
 }
 
+//Subscribe to values pushed by the server. cb must be a function receiving
+//a single non pointer argument. Its type will be registered in the codec.
 func (client *Client) SubscribeToPush(cb interface{}) error {
 	_, err := client.cbmgr.Subscribe(cb)
+	if err != nil {
+		return err
+	}
+	client.RegisterType(reflect.Zero(reflect.TypeOf(cb).In(0)).Interface())
+	return nil
+}
+
+//Subscribe to values published by the server to a topic. Only values
+//matching both the topic and the argument type of cb will be received.
+func (client *Client) SubscribeToTopic(topic string, cb interface{}) error {
+	sid, err := client.cbmgr.SubscribeToTopic(topic, cb)
+	if err != nil {
+		return err
+	}
+	client.RegisterType(reflect.Zero(reflect.TypeOf(cb).In(0)).Interface())
+	if err = client.Call(pubSubServiceName+".Subscribe", topic); err != nil {
+		client.cbmgr.Unsubscribe(sid)
+	}
 	return err
 }
 
+//Remove all the callbacks for a topic and stop receiving it from the server
+func (client *Client) UnsubscribeFromTopic(topic string) error {
+	client.cbmgr.UnsubscribeTopic(topic)
+	return client.Call(pubSubServiceName+".Unsubscribe", topic)
+}
+
+//Register a type that the server may send as push data
+func (client *Client) RegisterType(val interface{}) {
+	client.types.Register(val)
+}
+
+//Get the table of the types the client reads and sends. See Server.Types
+func (client *Client) Types() *TypeTable {
+	return client.types
+}
+
 // Go invokes the function asynchronously.  It returns the Call structure representing
 // the invocation.  The done channel will signal when the call is complete by returning
 // the same Call object.  If done is nil, Go will allocate a new channel.
@@ -211,6 +393,13 @@ func (client *Client) Go(done chan *Call, serviceMethod string, args ...interfac
 		}
 	}
 	call.Done = done
+	if invoker := client.interceptCall(); invoker != nil {
+		go func() {
+			call.Error = invoker(call)
+			call.done()
+		}()
+		return call
+	}
 	client.send(call)
 	return call
 }
@@ -221,6 +410,31 @@ func (client *Client) Call(serviceMethod string, args ...interface{}) error {
 	return call.Error
 }
 
+// Invoke calls a method that returns values, like
+// func(ctx *Context, a Args) (Reply, error), and returns them. Values of
+// types that are not builtin have to be registered with RegisterType.
+func (client *Client) Invoke(serviceMethod string, args ...interface{}) ([]interface{}, error) {
+	call := <-client.Go(make(chan *Call, 1), serviceMethod, args...).Done
+	return call.Results, call.Error
+}
+
+// Stream invokes a method that sends values with a *Stream. The values are
+// read with Recv on the returned stream.
+func (client *Client) Stream(serviceMethod string, args ...interface{}) *ClientStream {
+	call := &Call{Method: serviceMethod, Args: args, Done: make(chan *Call, 1)}
+	stream := newClientStream(call)
+	client.send(call)
+	return stream
+}
+
+// Upload invokes a method that receives values with a *RecvStream. The
+// values are sent with Send on the returned stream.
+func (client *Client) Upload(serviceMethod string, args ...interface{}) *UploadStream {
+	call := &Call{Method: serviceMethod, Args: args, Done: make(chan *Call, 1)}
+	client.send(call)
+	return &UploadStream{client: client, call: call}
+}
+
 /* Dial methods */
 
 // DialHTTP connects to an HTTP RPC server at the specified network address
@@ -232,8 +446,22 @@ func DialHTTP(network, address string) (*Client, error) {
 // DialHTTPPath connects to an HTTP RPC server
 // at the specified network address and path.
 func DialHTTPPath(network, address, path string) (*Client, error) {
+	conn, err := dialHTTPPath(network, address, path, nil)
+	if err != nil {
+		return nil, err
+	}
+	return NewClientHandshake(conn, DefaultHandshake)
+}
+
+//Connect with CONNECT. The connection uses TLS if config is set
+func dialHTTPPath(network, address, path string, config *tls.Config) (net.Conn, error) {
 	var err error
-	conn, err := net.Dial(network, address)
+	var conn net.Conn
+	if config != nil {
+		conn, err = tls.Dial(network, address, config)
+	} else {
+		conn, err = net.Dial(network, address)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -243,7 +471,7 @@ func DialHTTPPath(network, address, path string) (*Client, error) {
 	// before switching to RPC protocol.
 	resp, err := http.ReadResponse(bufio.NewReader(conn), &http.Request{Method: "CONNECT"})
 	if err == nil && resp.Status == connectedMsg {
-		return NewClient(conn), nil
+		return conn, nil
 	}
 	if err == nil {
 		err = errors.New("unexpected HTTP response: " + resp.Status)
@@ -262,25 +490,49 @@ func Dial(network string, address string) (*Client, error) {
 	if err != nil {
 		return nil, err
 	}
-	return NewClient(conn), nil
+	return NewClientHandshake(conn, DefaultHandshake)
 }
 
 /* New client methods */
 
 // It adds a buffer to the write side of the connection so
-// the header and payload are sent as a unit.
+// the header and payload are sent as a unit. No handshake is made so the
+// server has to use the default codec.
 func NewClient(conn io.ReadWriteCloser) *Client {
-	codec := new(gobCodec)
-	codec.SetRWC(conn)
-	return NewClientWithCodec(codec)
+	return newConnClient(conn, GenerateCodec(conn), new(CallbackManager), nil)
 }
 
 func NewClientWithCodec(codec Codec) *Client {
+	return newClient(codec, NewContext(), new(CallbackManager), nil)
+}
+
+func newConnClient(conn io.ReadWriteCloser, codec Codec, cbmgr *CallbackManager, registry *Registry) *Client {
+	ctx := NewContext()
+	if netConn, ok := conn.(net.Conn); ok {
+		ctx.setConn(netConn)
+		if state := tlsState(netConn); state != nil {
+			ctx.setTLSState(state)
+		}
+	}
+	return newClient(codec, ctx, cbmgr, registry)
+}
+
+func newClient(codec Codec, ctx *Context, cbmgr *CallbackManager, registry *Registry) *Client {
 	client := &Client{
-		codec:   codec,
-		pending: make(map[uint64]*Call),
-		cbmgr:   new(CallbackManager),
+		codec:        codec,
+		ctx:          ctx,
+		pending:      make(map[uint64]*Call),
+		cbmgr:        cbmgr,
+		registry:     registry,
+		disconnected: make(chan struct{}),
+	}
+	//Clients sharing a registry, like the ones of a ReconnectingClient, share the types too
+	if registry != nil {
+		client.types = registry.getTypes()
+	} else {
+		client.types = NewTypeTable()
 	}
+	codec.SetTypeTable(client.types)
 	go client.processInput()
 	return client
 }
@@ -299,12 +551,15 @@ func (client *Client) send(call *Call) {
 	}
 	seq := client.seq
 	client.seq++
+	call.seq = seq
 	client.pending[seq] = call
 	client.mutex.Unlock()
 
 	// Encode and send the request.
+	client.request.Type = call.reqType
 	client.request.Seq = seq
 	client.request.Method = call.Method
+	client.request.Metadata = call.Metadata
 	err := client.codec.WriteRequest(&client.request, call.Args)
 	if err != nil {
 		client.mutex.Lock()
@@ -4,12 +4,14 @@ import (
 	"bufio"
 	"compress/flate"
 	"encoding/gob"
+	"errors"
 	"io"
+	"reflect"
 	"sync"
 )
 
 type Codec interface {
-	Register(interface{})
+	SetTypeTable(*TypeTable)
 	WriteRequest(*Request, interface{}) error
 	WriteResponse(*Response, interface{}) error
 	ReadRequestHeader(*Request) error
@@ -20,41 +22,99 @@ type Codec interface {
 
 type gobCodec struct {
 	rwc       io.ReadWriteCloser
+	types     *TypeTable
 	dec       *gob.Decoder
+	buf       *bufio.Reader // what dec reads from when it is not compressed
 	enc       *gob.Encoder
 	zip       *flate.Writer
 	encBuf    *bufio.Writer
 	writeLock sync.Mutex
 }
 
-func (c *gobCodec) Register(val interface{}) {
-	gob.Register(val)
+// gobBody goes before the values of each body with the name of their types
+// so that values sent as interfaces can be read without gob.Register. Nil
+// values have no name and are not sent.
+type gobBody struct {
+	Types []string
+}
+
+func (c *gobCodec) SetTypeTable(types *TypeTable) {
+	c.types = types
 }
 
 func (c *gobCodec) SetRWC(rwc io.ReadWriteCloser) {
 	c.rwc = rwc
+	c.types = NewTypeTable()
 	c.zip, _ = flate.NewWriter(rwc, 9)
 	c.encBuf = bufio.NewWriter(c.zip)
 	c.dec = gob.NewDecoder(flate.NewReader(rwc))
 	c.enc = gob.NewEncoder(c.encBuf)
 }
 
+//Use rwc without compressing. The handshake sets up the compression
+func (c *gobCodec) setPlainRWC(rwc io.ReadWriteCloser) {
+	c.rwc = rwc
+	c.types = NewTypeTable()
+	c.encBuf = bufio.NewWriter(rwc)
+	c.buf = bufio.NewReader(rwc)
+	c.dec = gob.NewDecoder(c.buf)
+	c.enc = gob.NewEncoder(c.encBuf)
+}
+
 func (c *gobCodec) flush() error {
 	err := c.encBuf.Flush()
-	if err != nil {
+	if err != nil || c.zip == nil {
 		return err
 	}
 	return c.zip.Flush()
 }
 
+//Send the values of body after their type names
+func (c *gobCodec) encodeBody(body interface{}) error {
+	var values []interface{}
+	switch b := body.(type) {
+	case []interface{}:
+		values = b
+	case *interface{}:
+		values = []interface{}{*b}
+	default:
+		values = []interface{}{body}
+	}
+	header := gobBody{Types: make([]string, len(values))}
+	for iPos, value := range values {
+		//Nil pointers, like the ones a method can return, are sent as nil
+		if val := reflect.ValueOf(value); val.IsValid() && !(val.Kind() == reflect.Ptr && val.IsNil()) {
+			header.Types[iPos] = c.types.nameOf(val.Type())
+		}
+	}
+	if err := c.enc.Encode(&header); err != nil {
+		return err
+	}
+	for iPos, value := range values {
+		if header.Types[iPos] == "" {
+			continue
+		}
+		if err := c.enc.Encode(value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (c *gobCodec) WriteRequest(r *Request, body interface{}) (err error) {
 	c.writeLock.Lock()
 	defer c.writeLock.Unlock()
 	if err = c.enc.Encode(r); err != nil {
 		return
 	}
+	if err = flushFrame(c.encBuf, c.rwc, FrameHeader); err != nil {
+		return
+	}
 	if body != nil {
-		if err = c.enc.Encode(body); err != nil {
+		if err = c.encodeBody(body); err != nil {
+			return
+		}
+		if err = flushFrame(c.encBuf, c.rwc, FrameBody); err != nil {
 			return
 		}
 	}
@@ -67,24 +127,115 @@ func (c *gobCodec) WriteResponse(r *Response, body interface{}) (err error) {
 	if err = c.enc.Encode(r); err != nil {
 		return
 	}
+	if err = flushFrame(c.encBuf, c.rwc, FrameHeader); err != nil {
+		return
+	}
 	if body != nil {
-		if err = c.enc.Encode(body); err != nil {
+		if err = c.encodeBody(body); err != nil {
+			return
+		}
+		if err = flushFrame(c.encBuf, c.rwc, FrameBody); err != nil {
 			return
 		}
 	}
 	return c.flush()
 }
 
+//Close the frame of a header or body once it is read. Errors that leave the
+//frame read do not break the connection
+func (c *gobCodec) endRead(err error) error {
+	if c.buf == nil {
+		return err
+	}
+	if endErr := EndRead(c.rwc, c.buf.Buffered()); err == nil {
+		err = endErr
+	}
+	return err
+}
+
 func (c *gobCodec) ReadRequestHeader(r *Request) error {
-	return c.dec.Decode(r)
+	return c.endRead(c.dec.Decode(r))
 }
 
 func (c *gobCodec) ReadResponseHeader(r *Response) error {
-	return c.dec.Decode(r)
+	return c.endRead(c.dec.Decode(r))
 }
 
+// ReadBody decodes the next body into body. Slices of interfaces are decoded
+// into the pointers they hold, the way readArguments fills them, and the rest
+// of their values and empty interfaces get the type they were sent with.
+// Registered types arrive as pointers and builtin ones as values.
 func (c *gobCodec) ReadBody(body interface{}) error {
-	return c.dec.Decode(body)
+	return c.endRead(c.readBody(body))
+}
+
+func (c *gobCodec) readBody(body interface{}) error {
+	var header gobBody
+	if err := c.dec.Decode(&header); err != nil {
+		return err
+	}
+	var err error
+	switch target := body.(type) {
+	case nil:
+	case *[]interface{}:
+		values := make([]interface{}, len(header.Types))
+		copy(values, *target)
+		for iPos, name := range header.Types {
+			if values[iPos], err = c.decodeValue(name, values[iPos]); err != nil {
+				return c.discard(header.Types[iPos+1:], err)
+			}
+		}
+		*target = values
+		return nil
+	case *interface{}:
+		if len(header.Types) > 0 {
+			*target, err = c.decodeValue(header.Types[0], *target)
+			return c.discard(header.Types[1:], err)
+		}
+	default:
+		if len(header.Types) > 0 && header.Types[0] != "" {
+			err = c.dec.Decode(body)
+			return c.discard(header.Types[1:], err)
+		}
+	}
+	return c.discard(header.Types, nil)
+}
+
+//Decode a value of the named type into target or into a new value
+func (c *gobCodec) decodeValue(name string, target interface{}) (interface{}, error) {
+	if name == "" {
+		return nil, nil
+	}
+	//Values of another type are read as what they are for the caller to report it
+	if target != nil && c.types.nameOf(reflect.TypeOf(target)) == name {
+		return target, c.dec.Decode(target)
+	}
+	typ, ok := c.types.lookup(name)
+	if !ok {
+		c.dec.DecodeValue(reflect.Value{})
+		return nil, errors.New("Type " + name + " is not registered")
+	}
+	value := reflect.New(typ)
+	if err := c.dec.Decode(value.Interface()); err != nil {
+		return nil, err
+	}
+	if typ.PkgPath() == "" {
+		return value.Elem().Interface(), nil
+	}
+	return value.Interface(), nil
+}
+
+//Skip the values left in a body so that the next message can be read
+func (c *gobCodec) discard(names []string, err error) error {
+	for _, name := range names {
+		if name == "" {
+			continue
+		}
+		if dErr := c.dec.DecodeValue(reflect.Value{}); dErr != nil {
+			return dErr
+		}
+	}
+	return err
 }
 
 func (c *gobCodec) Close() error {
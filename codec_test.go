@@ -85,3 +85,27 @@ func TestGobCodec(t *testing.T) {
 	}
 
 }
+
+func TestGobCodecKeepsArguments(t *testing.T) {
+	buf := RWCMock{}
+	codec := GenerateGobCodec(&buf)
+	var nilReply *Reply
+	args := []interface{}{nilReply, 5}
+	if err := codec.WriteRequest(&Request{Type: R_RPC, Method: "A.B"}, args); err != nil {
+		t.Fatal(err)
+	}
+	if reply, ok := args[0].(*Reply); !ok || reply != nil {
+		t.Errorf("Arguments were changed to %#v", args)
+	}
+	readReq := new(Request)
+	if err := codec.ReadRequestHeader(readReq); err != nil {
+		t.Fatal(err)
+	}
+	values := []interface{}{nil, new(int)}
+	if err := codec.ReadBody(&values); err != nil {
+		t.Fatal(err)
+	}
+	if values[0] != nil || *values[1].(*int) != 5 {
+		t.Errorf("Unexpected values %#v", values)
+	}
+}
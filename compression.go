@@ -0,0 +1,84 @@
+package clacks
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"io"
+)
+
+const DefaultCompressionThreshold = 256 // frames smaller than this are not compressed
+
+// Compression is a scheme that can be negotiated in the handshake. Each
+// frame is compressed on its own with a writer and read with a reader. If
+// they have a Reset method like the ones of compress/flate and
+// compress/gzip they are reused between frames.
+type Compression struct {
+	NewWriter func(w io.Writer, level int) (io.WriteCloser, error)
+	NewReader func(r io.Reader) (io.ReadCloser, error)
+}
+
+var compressionsByName = map[string]Compression{
+	"flate": {
+		NewWriter: func(w io.Writer, level int) (io.WriteCloser, error) { return flate.NewWriter(w, level) },
+		NewReader: func(r io.Reader) (io.ReadCloser, error) { return flate.NewReader(r), nil },
+	},
+	"gzip": {
+		NewWriter: func(w io.Writer, level int) (io.WriteCloser, error) { return gzip.NewWriterLevel(w, level) },
+		NewReader: func(r io.Reader) (io.ReadCloser, error) { return gzip.NewReader(r) },
+	},
+}
+
+// RegisterCompression makes a compression scheme available by name to the
+// handshake of clients and servers. The built-in ones are flate, gzip and
+// none.
+func RegisterCompression(name string, compression Compression) {
+	handshakeLock.Lock()
+	defer handshakeLock.Unlock()
+	compressionsByName[name] = compression
+}
+
+func lookupCompression(name string) (*Compression, bool) {
+	if name == noCompression {
+		return nil, true
+	}
+	handshakeLock.RLock()
+	defer handshakeLock.RUnlock()
+	compression, ok := compressionsByName[name]
+	return &compression, ok
+}
+
+// CompressionStats counts the bytes of a connection before compressing and
+// after decompressing, and the bytes of the frames that carried them.
+type CompressionStats struct {
+	Scheme   string
+	BytesIn  uint64
+	BytesOut uint64
+	WireIn   uint64 // bytes of the frames read
+	WireOut  uint64 // bytes of the frames written
+}
+
+//Get the size of the frames written relative to the bytes sent
+func (cs CompressionStats) RatioOut() float64 {
+	if cs.BytesOut == 0 {
+		return 1
+	}
+	return float64(cs.WireOut) / float64(cs.BytesOut)
+}
+
+//Get the size of the frames read relative to the bytes received
+func (cs CompressionStats) RatioIn() float64 {
+	if cs.BytesIn == 0 {
+		return 1
+	}
+	return float64(cs.WireIn) / float64(cs.BytesIn)
+}
+
+// SetCompression sets the level and the threshold the server compresses
+// with once a compression scheme is negotiated. A level of 0 uses the
+// default one and a threshold of 0 uses DefaultCompressionThreshold.
+func (server *Server) SetCompression(level, threshold int) {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	server.compressLevel = level
+	server.compressThreshold = threshold
+}
@@ -0,0 +1,81 @@
+package clacks
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestCompressedFrames(t *testing.T) {
+	for _, scheme := range []string{"flate", "gzip"} {
+		compression, _ := lookupCompression(scheme)
+		buf := RWCMock{}
+		fc := newFrameConn(&buf, frameConfig{scheme: scheme, compression: compression, threshold: 64})
+		small := []byte("tiny")
+		big := []byte(strings.Repeat("compress me ", 100))
+		for _, data := range [][]byte{small, big, big} {
+			fc.Write(data)
+			if err := EndFrame(fc, FrameBody); err != nil {
+				t.Fatal(scheme, err)
+			}
+		}
+		if buf.data.Bytes()[1] != 0 {
+			t.Error(scheme, "frame below the threshold was compressed")
+		}
+		wire := uint64(buf.data.Len())
+		read := make([]byte, 0, len(small)+2*len(big))
+		for _, data := range [][]byte{small, big, big} {
+			frame := make([]byte, len(data))
+			if _, err := io.ReadFull(fc, frame); err != nil {
+				t.Fatal(scheme, err)
+			}
+			if err := EndRead(fc, 0); err != nil {
+				t.Fatal(scheme, err)
+			}
+			read = append(read, frame...)
+		}
+		if !bytes.Equal(read, append(append(small, big...), big...)) {
+			t.Error(scheme, "read data differs")
+		}
+		stats := fc.stats()
+		if stats.BytesOut != uint64(len(read)) || stats.BytesIn != stats.BytesOut {
+			t.Error(scheme, "unexpected byte counts", stats)
+		}
+		if stats.WireOut != wire || stats.WireIn != wire || stats.RatioOut() >= 0.5 {
+			t.Error(scheme, "unexpected frame counts", stats)
+		}
+		if _, err := fc.Read(read); err != io.EOF {
+			t.Error(scheme, "expected EOF and got", err)
+		}
+	}
+}
+
+func TestCompressionStats(t *testing.T) {
+	srv, addr := startAcceptServer(t, new(DummyService))
+	srv.SetCompression(9, 1)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("dialing", err)
+	}
+	client, err := NewClientHandshake(conn, Handshake{Codecs: []string{"json"}, Compression: []string{"gzip"}, Threshold: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	reply := new(Reply)
+	for i := 0; i < 10; i++ {
+		if err := client.Call("DummyService.Sum", Args{i, 2}, reply); err != nil || reply.Num != i+2 {
+			t.Fatal("call failed", err, reply.Num)
+		}
+	}
+	infos := srv.Connections()
+	if len(infos) != 1 {
+		t.Fatal("Expected one connection and got", len(infos))
+	}
+	stats := infos[0].Compression
+	if stats.Scheme != "gzip" || stats.BytesIn == 0 || stats.BytesOut == 0 || stats.WireIn == 0 || stats.WireOut == 0 {
+		t.Error("Unexpected compression stats", stats)
+	}
+}
@@ -0,0 +1,298 @@
+package clacks
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"reflect"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// countingConn keeps track of the bytes read and written through a net.Conn
+type countingConn struct {
+	bytesIn  uint64
+	bytesOut uint64
+	net.Conn
+}
+
+func (cc *countingConn) Read(data []byte) (n int, err error) {
+	n, err = cc.Conn.Read(data)
+	atomic.AddUint64(&cc.bytesIn, uint64(n))
+	return
+}
+
+func (cc *countingConn) Write(data []byte) (n int, err error) {
+	n, err = cc.Conn.Write(data)
+	atomic.AddUint64(&cc.bytesOut, uint64(n))
+	return
+}
+
+// connection holds the server side state of a connected client
+type connection struct {
+	inFlight    int64
+	id          uint64
+	server      *Server
+	ctx         *Context
+	codec       Codec
+	conn        *countingConn
+	frames      *frameConn // nil if the client did not handshake
+	connectedAt time.Time
+	callLock    sync.Mutex // protects following
+	callSeq     uint64
+	calls       map[uint64]*Call // calls sent to the client waiting for reply
+	streams     map[uint64]*RecvStream
+	closed      bool
+	used        bool       // a call has been made. Only used by the reading goroutine
+	pushLock    sync.Mutex // protects following
+	pushSeq     uint64
+	unacked     map[uint64]*unackedPush
+}
+
+func newConnection(server *Server, id uint64, ctx *Context, conn *countingConn, codec Codec) *connection {
+	return &connection{id: id, server: server, ctx: ctx, conn: conn, codec: codec, connectedAt: time.Now()}
+}
+
+// ConnectionInfo is a snapshot of the state of a connected client
+type ConnectionInfo struct {
+	ClientId    uint64
+	RemoteAddr  net.Addr
+	ConnectedAt time.Time
+	InFlight    int64 // calls being executed
+	BytesIn     uint64
+	BytesOut    uint64
+	Queued      int                         // responses and pushes waiting to be written
+	Dropped     uint64                      // pushes dropped because the queue was full
+	Compression CompressionStats            // empty if the client did not handshake
+	Metadata    map[interface{}]interface{} // values set with Context.SetValue
+}
+
+//Get the info of the connection. The id is passed because it can change
+//when a session is resumed
+func (conn *connection) info(clientId uint64) ConnectionInfo {
+	info := ConnectionInfo{
+		ClientId:    clientId,
+		RemoteAddr:  conn.conn.RemoteAddr(),
+		ConnectedAt: conn.connectedAt,
+		InFlight:    atomic.LoadInt64(&conn.inFlight),
+		BytesIn:     atomic.LoadUint64(&conn.conn.bytesIn),
+		BytesOut:    atomic.LoadUint64(&conn.conn.bytesOut),
+		Metadata:    conn.ctx.Values(),
+	}
+	if queue, ok := conn.codec.(*queuedCodec); ok {
+		info.Queued, info.Dropped = queue.stats()
+	}
+	if conn.frames != nil {
+		info.Compression = conn.frames.stats()
+	}
+	return info
+}
+
+//Tell the client why it is being disconnected and close the connection
+func (conn *connection) disconnect(reason string) error {
+	resp := conn.server.getResponse()
+	resp.Type = R_CLOSE
+	resp.Error = reason
+	var err error
+	if queue, ok := conn.codec.(*queuedCodec); ok {
+		err = queue.writeClose(resp)
+	} else {
+		err = conn.codec.WriteResponse(resp, nil)
+	}
+	conn.server.freeResponse(resp)
+	if err != nil {
+		log.Println("writing disconnect reason:", err)
+	}
+	return conn.codec.Close()
+}
+
+//Prepare a value to be sent as the body of a R_PUSH or R_DATA response
+func pushBody(value interface{}) (interface{}, error) {
+	val := reflect.Indirect(reflect.ValueOf(value))
+	if !val.IsValid() {
+		return nil, errors.New("Cannot send a nil value")
+	}
+	data := val.Interface()
+	return &data, nil
+}
+
+//Send a value to the client as a R_PUSH response. Topic may be empty.
+func (conn *connection) push(topic string, value interface{}) error {
+	data, err := pushBody(value)
+	if err != nil {
+		return err
+	}
+	resp := conn.server.getResponse()
+	defer conn.server.freeResponse(resp)
+	resp.Type = R_PUSH
+	resp.Topic = topic
+	resp.PushSeq = conn.retainPush(value)
+	if err = conn.codec.WriteResponse(resp, data); err != nil && resp.PushSeq != 0 {
+		conn.settlePush(resp.PushSeq, false)
+	}
+	return err
+}
+
+//Call a method registered in the client and wait for the reply
+func (conn *connection) callClient(serviceMethod string, args []interface{}) error {
+	call := &Call{Method: serviceMethod, Args: args, Done: make(chan *Call, 1)}
+	conn.callLock.Lock()
+	if conn.closed {
+		conn.callLock.Unlock()
+		return ErrShutdown
+	}
+	if conn.calls == nil {
+		conn.calls = make(map[uint64]*Call)
+	}
+	seq := conn.callSeq
+	conn.callSeq++
+	conn.calls[seq] = call
+	conn.callLock.Unlock()
+
+	resp := conn.server.getResponse()
+	resp.Type = R_CALL
+	resp.Seq = seq
+	resp.Method = serviceMethod
+	err := conn.codec.WriteResponse(resp, args)
+	conn.server.freeResponse(resp)
+	if err != nil {
+		conn.takeCall(seq)
+		return err
+	}
+	<-call.Done
+	return call.Error
+}
+
+func (conn *connection) takeCall(seq uint64) *Call {
+	conn.callLock.Lock()
+	defer conn.callLock.Unlock()
+	call := conn.calls[seq]
+	delete(conn.calls, seq)
+	return call
+}
+
+//Process the reply to a call made with callClient
+func (conn *connection) processReply(req *Request) error {
+	call := conn.takeCall(req.Seq)
+	switch {
+	case call == nil:
+		if req.Error == "" {
+			return conn.codec.ReadBody(nil)
+		}
+	case req.Error != "":
+		call.Error = ServerError(req.Error)
+		call.done()
+	default:
+		if err := readReplyBody(conn.codec, call); err != nil {
+			call.Error = errors.New("reading body " + err.Error())
+		}
+		call.done()
+	}
+	return nil
+}
+
+func (conn *connection) addStream(seq uint64, stream *RecvStream) {
+	conn.callLock.Lock()
+	defer conn.callLock.Unlock()
+	if conn.streams == nil {
+		conn.streams = make(map[uint64]*RecvStream)
+	}
+	conn.streams[seq] = stream
+}
+
+func (conn *connection) getStream(seq uint64) *RecvStream {
+	conn.callLock.Lock()
+	defer conn.callLock.Unlock()
+	return conn.streams[seq]
+}
+
+func (conn *connection) removeStream(seq uint64) {
+	conn.callLock.Lock()
+	defer conn.callLock.Unlock()
+	delete(conn.streams, seq)
+}
+
+//Fail all the calls waiting for a reply from the client and the streams
+//waiting for values
+func (conn *connection) close() {
+	conn.callLock.Lock()
+	defer conn.callLock.Unlock()
+	conn.closed = true
+	for seq, call := range conn.calls {
+		call.Error = ErrShutdown
+		call.done()
+		delete(conn.calls, seq)
+	}
+	for seq, stream := range conn.streams {
+		stream.finish(io.ErrUnexpectedEOF)
+		delete(conn.streams, seq)
+	}
+	go conn.expirePushes()
+}
+
+func (server *Server) addConnection(conn *connection) {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	if server.conns == nil {
+		server.conns = make(map[uint64]*connection)
+	}
+	server.conns[conn.id] = conn
+}
+
+func (server *Server) removeConnection(conn *connection) {
+	server.lock.Lock()
+	delete(server.conns, conn.id)
+	topics := server.topics.unsubscribeAll(conn.id)
+	server.lock.Unlock()
+	if sess := conn.ctx.getSession(); sess != nil {
+		server.sessions.detach(sess, conn, conn.ctx.Values(), topics)
+	}
+}
+
+// Connections returns a snapshot of all the connected clients
+func (server *Server) Connections() []ConnectionInfo {
+	server.lock.Lock()
+	conns := make(map[uint64]*connection, len(server.conns))
+	for clientId, conn := range server.conns {
+		conns[clientId] = conn
+	}
+	server.lock.Unlock()
+	infos := make([]ConnectionInfo, 0, len(conns))
+	for clientId, conn := range conns {
+		infos = append(infos, conn.info(clientId))
+	}
+	return infos
+}
+
+// Disconnect closes the connection of a client. The reason is sent to the
+// client and all its pending calls will fail with it.
+func (server *Server) Disconnect(clientId uint64, reason string) error {
+	conn := server.getConnection(clientId)
+	if conn == nil {
+		return errors.New("Unknown client " + strconv.FormatUint(clientId, 10))
+	}
+	return conn.disconnect(reason)
+}
+
+func (server *Server) getConnection(clientId uint64) *connection {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	return server.conns[clientId]
+}
+
+// Push sends a value to a connected client. The client receives it through
+// the callbacks registered with SubscribeToPush. If the client is away but
+// its session can still be resumed the value is buffered.
+func (server *Server) Push(clientId uint64, value interface{}) error {
+	conn := server.getConnection(clientId)
+	if conn == nil {
+		if server.sessions.buffer(clientId, value) {
+			return nil
+		}
+		return errors.New("Unknown client " + strconv.FormatUint(clientId, 10))
+	}
+	return conn.push("", value)
+}
@@ -1,7 +1,9 @@
 package clacks
 
 import (
+	"errors"
 	"net"
+	"sync"
 
 	"code.google.com/p/go.net/context"
 )
@@ -11,55 +13,168 @@ type contextKey int
 const (
 	connIdKey = iota
 	connKey
+	connectionKey
+	sessionKey
+	tlsStateKey
+	metadataKey
 )
 
 type Context struct {
-	ctx context.Context
+	lock   sync.RWMutex // protects following
+	ctx    context.Context
+	values map[interface{}]interface{} // values set by the user
+	base   *Context                    // context of the connection of a call
 }
 
 func NewContext() *Context {
-	return &Context{context.Background()}
+	return &Context{ctx: context.Background()}
+}
+
+func (me *Context) getCtx() context.Context {
+	me.lock.RLock()
+	defer me.lock.RUnlock()
+	return me.ctx
+}
+
+func (me *Context) withValue(key interface{}, value interface{}) {
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	me.ctx = context.WithValue(me.ctx, key, value)
 }
 
 //Get a Cancellation function for this context
 func (me *Context) GetCancelFunc() context.CancelFunc {
+	me.lock.Lock()
+	defer me.lock.Unlock()
 	var cancel context.CancelFunc
 	me.ctx, cancel = context.WithCancel(me.ctx)
 	return cancel
 }
 
 func (me *Context) Done() <-chan struct{} {
-	return me.ctx.Done()
+	return me.getCtx().Done()
+}
+
+//Get the context for a call with the metadata sent with it. It shares the
+//values set with SetValue with the context of the connection
+func (me *Context) forCall(metadata map[string]string) *Context {
+	if len(metadata) == 0 {
+		return me
+	}
+	return &Context{ctx: context.WithValue(me.getCtx(), metadataKey, metadata), base: me}
+}
+
+//Get a metadata value sent by the client with the call, like the ones
+//added by client interceptors
+func (me *Context) GetMetadata(key string) string {
+	return me.Metadata()[key]
+}
+
+//Get the metadata sent by the client with the call. It must not be modified
+func (me *Context) Metadata() map[string]string {
+	metadata, _ := me.getCtx().Value(metadataKey).(map[string]string)
+	return metadata
 }
 
 //Set a value for a key
 func (me *Context) SetValue(key interface{}, value interface{}) {
-	me.ctx = context.WithValue(me.ctx, key, value)
+	if me.base != nil {
+		me.base.SetValue(key, value)
+		return
+	}
+	me.lock.Lock()
+	defer me.lock.Unlock()
+	if me.values == nil {
+		me.values = make(map[interface{}]interface{})
+	}
+	me.values[key] = value
 }
 
 //Retrieve the value for a key
 func (me *Context) GetValue(key interface{}) interface{} {
+	if me.base != nil {
+		if value := me.base.GetValue(key); value != nil {
+			return value
+		}
+		return me.getCtx().Value(key)
+	}
+	me.lock.RLock()
+	defer me.lock.RUnlock()
+	if value, present := me.values[key]; present {
+		return value
+	}
 	return me.ctx.Value(key)
 }
 
+//Get a copy of all the values set with SetValue
+func (me *Context) Values() map[interface{}]interface{} {
+	if me.base != nil {
+		return me.base.Values()
+	}
+	me.lock.RLock()
+	defer me.lock.RUnlock()
+	values := make(map[interface{}]interface{}, len(me.values))
+	for key, value := range me.values {
+		values[key] = value
+	}
+	return values
+}
+
 func (me *Context) setClientId(connId uint64) {
-	me.ctx = context.WithValue(me.ctx, connIdKey, connId)
+	me.withValue(connIdKey, connId)
 }
 
 //Get the client id
 func (me *Context) GetClientId() uint64 {
-	return me.ctx.Value(connIdKey).(uint64)
+	return me.getCtx().Value(connIdKey).(uint64)
 }
 
 func (me *Context) setConn(conn net.Conn) {
-	me.ctx = context.WithValue(me.ctx, connKey, conn)
+	me.withValue(connKey, conn)
 }
 
 func (me *Context) getConn() net.Conn {
-	return me.ctx.Value(connKey).(net.Conn)
+	return me.getCtx().Value(connKey).(net.Conn)
 }
 
 //Get client IP from context
 func (me *Context) GetClientAddr() net.Addr {
 	return me.getConn().RemoteAddr()
-}
\ No newline at end of file
+}
+
+func (me *Context) setConnection(conn *connection) {
+	me.withValue(connectionKey, conn)
+}
+
+func (me *Context) getConnection() *connection {
+	conn, _ := me.getCtx().Value(connectionKey).(*connection)
+	return conn
+}
+
+func (me *Context) setSession(sess *session) {
+	me.withValue(sessionKey, sess)
+}
+
+func (me *Context) getSession() *session {
+	sess, _ := me.getCtx().Value(sessionKey).(*session)
+	return sess
+}
+
+//Call a method registered in the client that owns this context and wait
+//for the reply. Pointer arguments are filled with the values sent back.
+func (me *Context) CallClient(serviceMethod string, args ...interface{}) error {
+	conn := me.getConnection()
+	if conn == nil {
+		return errors.New("Context is not bound to a connection")
+	}
+	return conn.callClient(serviceMethod, args)
+}
+
+//Push a value to the client that owns this context
+func (me *Context) Push(value interface{}) error {
+	conn := me.getConnection()
+	if conn == nil {
+		return errors.New("Context is not bound to a connection")
+	}
+	return conn.push("", value)
+}
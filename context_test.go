@@ -36,3 +36,18 @@ func TestGenericGetSet(t *testing.T) {
 		t.Error("Get/Set differ")
 	}
 }
+
+func TestValues(t *testing.T) {
+	ctx := NewContext()
+	ctx.setClientId(3)
+	ctx.SetValue("a", 1)
+	ctx.SetValue("b", 2)
+	values := ctx.Values()
+	if len(values) != 2 || values["a"] != 1 || values["b"] != 2 {
+		t.Error("Values differ from the ones set")
+	}
+	values["c"] = 3
+	if ctx.GetValue("c") != nil {
+		t.Error("Values is not a copy")
+	}
+}
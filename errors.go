@@ -0,0 +1,132 @@
+package clacks
+
+import "errors"
+
+// ErrorCode identifies the kind of an Error. It travels with the error so
+// that clients can tell what went wrong without parsing messages.
+type ErrorCode string
+
+const (
+	CodeNotFound         ErrorCode = "not_found"
+	CodeAlreadyExists    ErrorCode = "already_exists"
+	CodePermissionDenied ErrorCode = "permission_denied"
+	CodeUnauthenticated  ErrorCode = "unauthenticated"
+	CodeInvalidArgument  ErrorCode = "invalid_argument"
+	CodeUnavailable      ErrorCode = "unavailable"
+	CodeInternal         ErrorCode = "internal"
+	// CodeUnknownMethod is a not found error for calls to methods that are
+	// not registered
+	CodeUnknownMethod ErrorCode = "unknown_method"
+)
+
+// maxErrorCauses limits the wrapped errors sent with the error of a call
+const maxErrorCauses = 16
+
+// Errors with the well-known codes. Methods can return them, wrap them or
+// return another Error with the same code, and clients can check for them
+// with errors.Is.
+var (
+	ErrNotFound         = &Error{Code: CodeNotFound, Message: "not found"}
+	ErrAlreadyExists    = &Error{Code: CodeAlreadyExists, Message: "already exists"}
+	ErrPermissionDenied = &Error{Code: CodePermissionDenied, Message: "permission denied"}
+	ErrUnauthenticated  = &Error{Code: CodeUnauthenticated, Message: "unauthenticated"}
+	ErrInvalidArgument  = &Error{Code: CodeInvalidArgument, Message: "invalid argument"}
+	ErrUnavailable      = &Error{Code: CodeUnavailable, Message: "unavailable", Retryable: true}
+	ErrInternal         = &Error{Code: CodeInternal, Message: "internal error"}
+	ErrUnknownMethod    = &Error{Code: CodeUnknownMethod, Message: "unknown method"}
+)
+
+// ErrorCause is an error wrapped by the error of a call as it is sent to the
+// client. Code is empty for the causes that are not an *Error.
+type ErrorCause struct {
+	Code    string `json:"code,omitempty"`
+	Message string `json:"message"`
+}
+
+// Error is an error that keeps its code, retryable flag and detail when it
+// is sent to the client. Methods return it, or an error that wraps it, and
+// the client gets it back as an *Error with the message of the error the
+// method returned. The errors it wraps are sent with their code and message
+// and the client gets them as the *Errors it wraps. The detail is sent like a
+// push, so its type has to be registered in the client. Errors without a
+// code arrive as ServerError, and the ones with a code can also be read as a
+// ServerError with errors.As.
+type Error struct {
+	Code      ErrorCode
+	Message   string
+	Retryable bool        // the call can be made again
+	Detail    interface{} // extra information about the error
+	cause     error       // error it wraps
+	remote    bool        // received from the server
+}
+
+// NewError creates an Error with a code and a message.
+func NewError(code ErrorCode, message string) *Error {
+	return &Error{Code: code, Message: message}
+}
+
+// WrapError creates an Error with a code that wraps another error and takes
+// its message.
+func WrapError(code ErrorCode, cause error) *Error {
+	return &Error{Code: code, Message: cause.Error(), cause: cause}
+}
+
+func (e *Error) Error() string {
+	if e.Message == "" {
+		return string(e.Code)
+	}
+	return e.Message
+}
+
+func (e *Error) Unwrap() error {
+	return e.cause
+}
+
+//Errors match the ones with the same code, like the well-known ones.
+//Unknown methods are also not found errors
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	if !ok || t.Code == "" {
+		return false
+	}
+	return t.Code == e.Code || (t.Code == CodeNotFound && e.Code == CodeUnknownMethod)
+}
+
+//Errors received from the server can be read as a ServerError like the ones
+//without a code
+func (e *Error) As(target interface{}) bool {
+	serverErr, ok := target.(*ServerError)
+	if ok && e.remote {
+		*serverErr = ServerError(e.Error())
+	}
+	return ok && e.remote
+}
+
+//Get the errors wrapped by err, outermost first
+func errorCauses(err error) []ErrorCause {
+	var causes []ErrorCause
+	for cause := errors.Unwrap(err); cause != nil && len(causes) < maxErrorCauses; cause = errors.Unwrap(cause) {
+		ec := ErrorCause{Message: cause.Error()}
+		if sErr, ok := cause.(*Error); ok {
+			ec.Code = string(sErr.Code)
+		}
+		causes = append(causes, ec)
+	}
+	return causes
+}
+
+//Rebuild the chain of errors wrapped by an error received from the server
+func remoteCauses(causes []ErrorCause) error {
+	var cause error
+	for iPos := len(causes) - 1; iPos >= 0; iPos-- {
+		cause = &Error{Code: ErrorCode(causes[iPos].Code), Message: causes[iPos].Message, cause: cause, remote: true}
+	}
+	return cause
+}
+
+//Get a copy of the error with a detail
+func (e *Error) WithDetail(detail interface{}) *Error {
+	withDetail := *e
+	withDetail.Detail = detail
+	return &withDetail
+}
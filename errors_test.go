@@ -0,0 +1,166 @@
+package clacks
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type DeniedDetail struct {
+	Role string
+}
+
+type UnknownDetail struct {
+	Value int
+}
+
+type ErrorService struct{}
+
+func (es *ErrorService) Find(ctx *Context, a Args) error {
+	return fmt.Errorf("user %d: %w", a.A, ErrNotFound)
+}
+
+func (es *ErrorService) Deny(ctx *Context, a Args) error {
+	return ErrPermissionDenied.WithDetail(DeniedDetail{"admin"})
+}
+
+func (es *ErrorService) Busy(ctx *Context, a Args) error {
+	return &Error{Code: CodeUnavailable, Message: "busy", Retryable: true, Detail: &UnknownDetail{1}}
+}
+
+func (es *ErrorService) Chain(ctx *Context, a Args) error {
+	return WrapError(CodeInternal, fmt.Errorf("loading user: %w", ErrNotFound))
+}
+
+func (es *ErrorService) Plain(ctx *Context, a Args) error {
+	return errors.New("plain")
+}
+
+func TestErrorIs(t *testing.T) {
+	err := fmt.Errorf("loading: %w", NewError(CodeNotFound, "no user"))
+	if !errors.Is(err, ErrNotFound) || errors.Is(err, ErrPermissionDenied) {
+		t.Error("Errors have to match the ones with the same code")
+	}
+	cause := errors.New("disk full")
+	wrapped := WrapError(CodeInternal, cause)
+	if !errors.Is(wrapped, cause) || !errors.Is(wrapped, ErrInternal) || wrapped.Error() != "disk full" {
+		t.Error("Wrapped errors have to keep their cause")
+	}
+	if detailed := ErrNotFound.WithDetail(1); detailed == ErrNotFound || ErrNotFound.Detail != nil {
+		t.Error("WithDetail has to copy the error")
+	}
+}
+
+func TestStructuredErrors(t *testing.T) {
+	_, addr := startAcceptServer(t, new(ErrorService))
+	for _, codec := range []string{"gob", "json", "msgpack"} {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal("dialing", err)
+		}
+		client, err := NewClientHandshake(conn, Handshake{Codecs: []string{codec}})
+		if err != nil {
+			t.Fatal(codec, err)
+		}
+		client.RegisterType(DeniedDetail{})
+
+		err = client.Call("ErrorService.Find", Args{7, 0})
+		if !errors.Is(err, ErrNotFound) || err.Error() != "user 7: not found" {
+			t.Error(codec, "Expected a not found error and got", err)
+		}
+		var serverErr ServerError
+		if !errors.As(err, &serverErr) || string(serverErr) != "user 7: not found" {
+			t.Error(codec, "Structured errors have to wrap a ServerError")
+		}
+
+		err = client.Call("ErrorService.Deny", Args{})
+		var sErr *Error
+		if !errors.As(err, &sErr) || sErr.Code != CodePermissionDenied || sErr.Retryable {
+			t.Fatal(codec, "Expected a permission denied error and got", err)
+		}
+		if !reflect.DeepEqual(sErr.Detail, DeniedDetail{"admin"}) {
+			t.Errorf("%s: Unexpected detail %#v", codec, sErr.Detail)
+		}
+
+		//Details of types that are not registered are left out
+		err = client.Call("ErrorService.Busy", Args{})
+		if !errors.As(err, &sErr) || sErr.Code != CodeUnavailable || !sErr.Retryable || sErr.Message != "busy" {
+			t.Error(codec, "Expected an unavailable error and got", err)
+		}
+		if codec == "gob" && sErr.Detail != nil {
+			t.Errorf("%s: Unexpected detail %#v", codec, sErr.Detail)
+		}
+
+		//Wrapped errors keep their codes and messages
+		err = client.Call("ErrorService.Chain", Args{})
+		if !errors.Is(err, ErrInternal) || !errors.Is(err, ErrNotFound) || errors.Is(err, ErrPermissionDenied) {
+			t.Error(codec, "Expected an internal error wrapping a not found one and got", err)
+		}
+		messages := make([]string, 0)
+		for cause := errors.Unwrap(err); cause != nil; cause = errors.Unwrap(cause) {
+			messages = append(messages, cause.Error())
+		}
+		if !reflect.DeepEqual(messages, []string{"loading user: not found", "not found"}) {
+			t.Error(codec, "Unexpected causes", messages)
+		}
+
+		err = client.Call("ErrorService.Plain", Args{})
+		if _, ok := err.(ServerError); !ok || err.Error() != "plain" {
+			t.Error(codec, "Errors without a code have to be ServerErrors and got", err)
+		}
+		if err = client.Call("ErrorService.Missing", Args{}); !errors.Is(err, ErrUnknownMethod) || !errors.Is(err, ErrNotFound) {
+			t.Error(codec, "Expected a not found error for a missing method and got", err)
+		}
+		client.Close()
+	}
+}
+
+func TestJSONRPCErrorData(t *testing.T) {
+	srv := NewServer()
+	srv.CodecFunc(GenerateJSONRPCCodec)
+	srv.Register(new(ErrorService))
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen tcp :0: %v", err)
+	}
+	go srv.Accept(l)
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal("dialing", err)
+	}
+	defer conn.Close()
+	conn.Write([]byte(`{"jsonrpc":"2.0","method":"ErrorService.Deny","params":[{}],"id":1}` + "\n"))
+	var resp struct {
+		Error *struct {
+			Code int
+			Data *struct {
+				Code   string
+				Detail DeniedDetail
+			}
+		}
+	}
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if err = json.NewDecoder(conn).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	if resp.Error == nil || resp.Error.Code != JSONRPCServerError || resp.Error.Data == nil {
+		t.Fatal("Unexpected response", resp.Error)
+	}
+	if resp.Error.Data.Code != string(CodePermissionDenied) || resp.Error.Data.Detail.Role != "admin" {
+		t.Error("Unexpected error data", *resp.Error.Data)
+	}
+}
+
+func TestUnregisterNotFound(t *testing.T) {
+	srv := NewServer()
+	if err := srv.Unregister("Missing"); !errors.Is(err, ErrNotFound) {
+		t.Error("Expected a not found error and got", err)
+	}
+	if err := srv.Replace("Missing", new(ErrorService)); !errors.Is(err, ErrNotFound) {
+		t.Error("Expected a not found error and got", err)
+	}
+}
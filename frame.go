@@ -0,0 +1,299 @@
+package clacks
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"io"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// FrameType tells whether a frame carries the header or the body of a
+// message. Each type has its own maximum size.
+type FrameType byte
+
+const (
+	FrameHeader FrameType = iota
+	FrameBody
+	numFrameTypes
+)
+
+const (
+	DefaultMaxHeaderSize = 64 << 10
+	DefaultMaxBodySize   = 16 << 20
+	frameCompressed      = 1 // flag of frames whose payload is compressed
+)
+
+// ProtocolError is returned when the peer breaks the protocol, like sending
+// a frame bigger than allowed. The connection is closed after it.
+type ProtocolError string
+
+func (e ProtocolError) Error() string {
+	return string(e)
+}
+
+// frameConfig is what each side sets up for the frames of a connection
+type frameConfig struct {
+	scheme        string
+	compression   *Compression // nil sends everything uncompressed
+	level         int
+	threshold     int
+	maxHeaderSize int
+	maxBodySize   int
+}
+
+// frameConn sits between a codec and the connection. What the codec writes
+// is held until it calls EndFrame and then sent as a frame made of the type,
+// the flags, the length and the payload, which is compressed if it is bigger
+// than the threshold. Frames bigger than the limit of their type are refused
+// before reading them. Each header and body is read from a single frame,
+// which the codec closes with EndRead, so the limits apply to whole
+// messages.
+type frameConn struct {
+	bytesIn, bytesOut, wireIn, wireOut uint64
+	io.ReadWriteCloser
+	config    frameConfig
+	limits    [numFrameTypes]int
+	reader    *bufio.Reader
+	pending   []byte // payload not read yet
+	reading   bool   // a header or body is being read from the last frame
+	err       error  // once reading fails it keeps failing
+	zr        io.ReadCloser
+	writeLock sync.Mutex // protects following
+	out       bytes.Buffer
+	frame     bytes.Buffer
+	zw        io.WriteCloser
+}
+
+func newFrameConn(rwc io.ReadWriteCloser, config frameConfig) *frameConn {
+	if config.level == 0 {
+		config.level = flate.DefaultCompression
+	}
+	if config.threshold <= 0 {
+		config.threshold = DefaultCompressionThreshold
+	}
+	if config.maxHeaderSize <= 0 {
+		config.maxHeaderSize = DefaultMaxHeaderSize
+	}
+	if config.maxBodySize <= 0 {
+		config.maxBodySize = DefaultMaxBodySize
+	}
+	return &frameConn{
+		ReadWriteCloser: rwc,
+		config:          config,
+		limits:          [numFrameTypes]int{config.maxHeaderSize, config.maxBodySize},
+		reader:          bufio.NewReader(rwc),
+	}
+}
+
+// EndFrame sends what a codec has written to w since the last call as a
+// frame of the given type. Codecs used through the handshake call it after
+// each header and body, once their buffers are flushed. It does nothing if
+// w is not framed.
+func EndFrame(w io.Writer, typ FrameType) error {
+	if fc, ok := w.(*frameConn); ok {
+		return fc.endFrame(typ)
+	}
+	return nil
+}
+
+//Flush buf and send what it held as a frame if w is framed. Unframed
+//streams are left buffered to be flushed with the whole message
+func flushFrame(buf *bufio.Writer, w io.Writer, typ FrameType) error {
+	if _, ok := w.(*frameConn); !ok {
+		return nil
+	}
+	if err := buf.Flush(); err != nil {
+		return err
+	}
+	return EndFrame(w, typ)
+}
+
+func (fc *frameConn) Write(data []byte) (int, error) {
+	fc.writeLock.Lock()
+	defer fc.writeLock.Unlock()
+	return fc.out.Write(data)
+}
+
+//Compress data into the frame buffer reusing the writer if possible
+func (fc *frameConn) compress(data []byte) error {
+	fc.frame.Reset()
+	if zw, ok := fc.zw.(interface{ Reset(io.Writer) }); ok {
+		zw.Reset(&fc.frame)
+	} else {
+		var err error
+		if fc.zw, err = fc.config.compression.NewWriter(&fc.frame, fc.config.level); err != nil {
+			return err
+		}
+	}
+	if _, err := fc.zw.Write(data); err != nil {
+		return err
+	}
+	return fc.zw.Close()
+}
+
+func (fc *frameConn) endFrame(typ FrameType) error {
+	fc.writeLock.Lock()
+	defer fc.writeLock.Unlock()
+	data := fc.out.Bytes()
+	defer fc.out.Reset()
+	var header [binary.MaxVarintLen64 + 2]byte
+	header[0] = byte(typ)
+	payload := data
+	if fc.config.compression != nil && len(data) >= fc.config.threshold {
+		if err := fc.compress(data); err != nil {
+			return err
+		}
+		if fc.frame.Len() < len(data) {
+			header[1] = frameCompressed
+			payload = fc.frame.Bytes()
+		}
+	}
+	n := binary.PutUvarint(header[2:], uint64(len(payload))) + 2
+	if _, err := fc.ReadWriteCloser.Write(append(header[:n], payload...)); err != nil {
+		return err
+	}
+	atomic.AddUint64(&fc.bytesOut, uint64(len(data)))
+	atomic.AddUint64(&fc.wireOut, uint64(n+len(payload)))
+	return nil
+}
+
+//Decompress a frame reusing the reader if possible
+func (fc *frameConn) decompress(data []byte, limit int) ([]byte, error) {
+	source := bytes.NewReader(data)
+	var err error
+	switch zr := fc.zr.(type) {
+	case flate.Resetter:
+		err = zr.Reset(source, nil)
+	case interface{ Reset(io.Reader) error }:
+		err = zr.Reset(source)
+	default:
+		fc.zr, err = fc.config.compression.NewReader(source)
+	}
+	if err != nil {
+		return nil, err
+	}
+	out, err := io.ReadAll(io.LimitReader(fc.zr, int64(limit)+1))
+	if err == nil && len(out) > limit {
+		err = ProtocolError("Decompressed frame exceeds the limit of " + strconv.Itoa(limit) + " bytes")
+	}
+	return out, err
+}
+
+func (fc *frameConn) readFrame() error {
+	var header [2]byte
+	if _, err := io.ReadFull(fc.reader, header[:]); err != nil {
+		return err
+	}
+	size, err := binary.ReadUvarint(fc.reader)
+	if err != nil {
+		return unexpectedEOF(err)
+	}
+	typ, flags := FrameType(header[0]), header[1]
+	if typ >= numFrameTypes {
+		return ProtocolError("Unknown frame type " + strconv.Itoa(int(typ)))
+	}
+	limit := fc.limits[typ]
+	if size > uint64(limit) {
+		return ProtocolError("Frame of " + strconv.FormatUint(size, 10) + " bytes exceeds the limit of " + strconv.Itoa(limit))
+	}
+	data := make([]byte, size)
+	if _, err = io.ReadFull(fc.reader, data); err != nil {
+		return unexpectedEOF(err)
+	}
+	atomic.AddUint64(&fc.wireIn, uint64(2+uvarintLen(size))+size)
+	switch {
+	case flags&^frameCompressed != 0:
+		return ProtocolError("Unknown frame flags " + strconv.Itoa(int(flags)))
+	case flags&frameCompressed == 0:
+	case fc.config.compression == nil:
+		return ProtocolError("Received a compressed frame without compression")
+	default:
+		if data, err = fc.decompress(data, limit); err != nil {
+			return err
+		}
+	}
+	atomic.AddUint64(&fc.bytesIn, uint64(len(data)))
+	fc.pending = data
+	return nil
+}
+
+func uvarintLen(x uint64) int {
+	n := 1
+	for ; x >= 0x80; x >>= 7 {
+		n++
+	}
+	return n
+}
+
+//A stream that ends in the middle of a frame is broken
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+func (fc *frameConn) Read(data []byte) (int, error) {
+	for len(fc.pending) == 0 {
+		if fc.err != nil {
+			return 0, fc.err
+		}
+		if fc.reading {
+			fc.err = ProtocolError("Message continues past the end of its frame")
+			continue
+		}
+		fc.err = fc.readFrame()
+		fc.reading = true
+	}
+	n := copy(data, fc.pending)
+	fc.pending = fc.pending[n:]
+	return n, nil
+}
+
+// EndRead tells the frames under r that a codec has read a whole header or
+// body, so that the next one starts a new frame. Codecs used through the
+// handshake call it after reading each header and body, with the bytes they
+// read ahead and did not use. A message that leaves part of its frame unread
+// is a ProtocolError. It does nothing if r is not framed.
+func EndRead(r io.Reader, buffered int) error {
+	if fc, ok := r.(*frameConn); ok {
+		return fc.endRead(buffered)
+	}
+	return nil
+}
+
+func (fc *frameConn) endRead(buffered int) error {
+	if buffered > 0 || len(fc.pending) > 0 {
+		fc.err = ProtocolError("Frame has " + strconv.Itoa(buffered+len(fc.pending)) + " bytes after its message")
+		return fc.err
+	}
+	fc.reading = false
+	return nil
+}
+
+func (fc *frameConn) stats() CompressionStats {
+	return CompressionStats{
+		Scheme:   fc.config.scheme,
+		BytesIn:  atomic.LoadUint64(&fc.bytesIn),
+		BytesOut: atomic.LoadUint64(&fc.bytesOut),
+		WireIn:   atomic.LoadUint64(&fc.wireIn),
+		WireOut:  atomic.LoadUint64(&fc.wireOut),
+	}
+}
+
+// SetMaxMessageSize sets the biggest header and body the server accepts from
+// clients that connect with a handshake. A value of 0 uses the default. The
+// connection is closed with a ProtocolError when a client sends more. The
+// limits are opt-in: clients that connect without a handshake are served
+// with the codec set with CodecFunc and their messages can be of any size.
+// Set RequireHandshake to refuse them.
+func (server *Server) SetMaxMessageSize(header, body int) {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	server.maxHeaderSize = header
+	server.maxBodySize = body
+}
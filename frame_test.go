@@ -0,0 +1,151 @@
+package clacks
+
+import (
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFrameLimits(t *testing.T) {
+	buf := RWCMock{}
+	writer := newFrameConn(&buf, frameConfig{})
+	reader := newFrameConn(&buf, frameConfig{maxHeaderSize: 8, maxBodySize: 16})
+	io.WriteString(writer, "header")
+	EndFrame(writer, FrameHeader)
+	io.WriteString(writer, "a body that is too big")
+	EndFrame(writer, FrameBody)
+	data := make([]byte, 6)
+	if _, err := io.ReadFull(reader, data); err != nil || string(data) != "header" {
+		t.Fatal("Unexpected header", string(data), err)
+	}
+	if err := EndRead(reader, 0); err != nil {
+		t.Fatal(err)
+	}
+	_, err := reader.Read(data)
+	if _, ok := err.(ProtocolError); !ok || !strings.Contains(err.Error(), "exceeds the limit of 16") {
+		t.Fatal("Expected a protocol error and got", err)
+	}
+	if _, again := reader.Read(data); again != err {
+		t.Error("Reading after a protocol error should fail again and got", again)
+	}
+
+	//Compressed frames are also limited once decompressed
+	compression, _ := lookupCompression("flate")
+	writer = newFrameConn(&buf, frameConfig{compression: compression, threshold: 1})
+	reader = newFrameConn(&buf, frameConfig{compression: compression, maxBodySize: 100})
+	io.WriteString(writer, strings.Repeat("a", 1000))
+	EndFrame(writer, FrameBody)
+	if buf.data.Len() > 100 {
+		t.Fatal("Frame was not compressed")
+	}
+	if _, err := reader.Read(data); err == nil || !strings.Contains(err.Error(), "Decompressed frame exceeds") {
+		t.Error("Expected the decompressed frame to be refused and got", err)
+	}
+}
+
+func TestMessageInOneFrame(t *testing.T) {
+	for name, codecFunc := range map[string]codecFunc{"gob": GenerateGobCodec, "json": GenerateJSONCodec, "msgpack": GenerateMsgpackCodec} {
+		//A header split in two frames
+		buf := RWCMock{}
+		plain := RWCMock{}
+		codecFunc(&plain).WriteRequest(&Request{Type: R_RPC, Method: "DummyService.Sum", Seq: 1}, nil)
+		header := plain.data.Bytes()
+		writer := newFrameConn(&buf, frameConfig{})
+		writer.Write(header[:len(header)/2])
+		EndFrame(writer, FrameHeader)
+		writer.Write(header[len(header)/2:])
+		EndFrame(writer, FrameHeader)
+		req := new(Request)
+		err := codecFunc(newFrameConn(&buf, frameConfig{})).ReadRequestHeader(req)
+		if _, ok := err.(ProtocolError); !ok || !strings.Contains(err.Error(), "past the end of its frame") {
+			t.Error(name, "Expected a protocol error reading a split header and got", err)
+		}
+
+		//Two headers in a frame
+		buf = RWCMock{}
+		writer = newFrameConn(&buf, frameConfig{})
+		writer.Write(header)
+		writer.Write(header)
+		EndFrame(writer, FrameHeader)
+		err = codecFunc(newFrameConn(&buf, frameConfig{})).ReadRequestHeader(req)
+		if _, ok := err.(ProtocolError); !ok || !strings.Contains(err.Error(), "after its message") {
+			t.Error(name, "Expected a protocol error reading two headers and got", err)
+		}
+	}
+}
+
+func TestMaxMessageSize(t *testing.T) {
+	srv, addr := startAcceptServer(t, new(DummyService))
+	srv.SetMaxMessageSize(0, 64)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("dialing", err)
+	}
+	client, err := NewClientHandshake(conn, Handshake{Codecs: []string{"json"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	reply := new(Reply)
+	if err := client.Call("DummyService.Sum", Args{1, 2}, reply); err != nil || reply.Num != 3 {
+		t.Fatal("call failed", err, reply.Num)
+	}
+	err = client.Call("DummyService.Sum", strings.Repeat("x", 100), reply)
+	if err == nil || !strings.Contains(err.Error(), "Protocol error: Frame of") {
+		t.Error("Expected the server to refuse the body and got", err)
+	}
+	select {
+	case <-client.disconnected:
+	case <-time.After(time.Second):
+		t.Error("Client was not disconnected")
+	}
+
+	//Clients limit what they accept too
+	srv.SetMaxMessageSize(0, 0)
+	conn, err = net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("dialing", err)
+	}
+	client, err = NewClientHandshake(conn, Handshake{Codecs: []string{"gob"}, MaxBodySize: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	err = client.Call("DummyService.Sum", Args{1, 2}, reply)
+	if err == nil || !strings.Contains(err.Error(), "exceeds the limit of 1") {
+		t.Error("Expected the client to refuse the reply and got", err)
+	}
+	select {
+	case <-client.disconnected:
+	case <-time.After(time.Second):
+		t.Error("Client did not close the connection")
+	}
+}
+
+func TestRequireHandshake(t *testing.T) {
+	srv, addr := startAcceptServer(t, new(DummyService))
+	srv.RequireHandshake(true)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("dialing", err)
+	}
+	client := NewClient(conn)
+	defer client.Close()
+	if err := client.Call("DummyService.Sum", Args{1, 2}, new(Reply)); err == nil {
+		t.Error("Client without handshake was served")
+	}
+	conn, err = net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("dialing", err)
+	}
+	client, err = NewClientHandshake(conn, DefaultHandshake)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	if err := client.Call("DummyService.Sum", Args{1, 2}, new(Reply)); err != nil {
+		t.Error("Client with handshake was not served", err)
+	}
+}
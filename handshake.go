@@ -0,0 +1,304 @@
+package clacks
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	ProtocolVersion         = 2
+	DefaultHandshakeTimeout = time.Second
+	handshakeMagic          = "CLACKS/"
+	noCompression           = "none"
+)
+
+// Handshake is what a client proposes when it connects. The server picks the
+// first codec and compression of each list that it knows.
+// Level and Threshold are used to compress what the client sends, as
+// with Server.SetCompression, and MaxHeaderSize and MaxBodySize limit what
+// it accepts, as with Server.SetMaxMessageSize. Timeout is how long the
+// client waits for the server to answer. 0 uses DefaultHandshakeTimeout.
+type Handshake struct {
+	Codecs        []string
+	Compression   []string
+	Level         int
+	Threshold     int
+	MaxHeaderSize int
+	MaxBodySize   int
+	Timeout       time.Duration
+}
+
+var DefaultHandshake = Handshake{
+	Codecs:      []string{"gob"},
+	Compression: []string{"flate", noCompression},
+}
+
+var (
+	handshakeLock sync.RWMutex // protects following
+	codecsByName  = map[string]codecFunc{
+		"gob":     GenerateGobCodec,
+		"json":    GenerateJSONCodec,
+		"msgpack": GenerateMsgpackCodec,
+	}
+)
+
+// RegisterCodec makes a codec available by name to the handshake of clients
+// and servers. The built-in ones are gob, json and msgpack. The stream given
+// to the codec is framed so it has to call EndFrame after writing each header
+// and body and EndRead after reading them.
+func RegisterCodec(name string, codec codecFunc) {
+	handshakeLock.Lock()
+	defer handshakeLock.Unlock()
+	codecsByName[name] = codec
+}
+
+func lookupCodec(name string) codecFunc {
+	handshakeLock.RLock()
+	defer handshakeLock.RUnlock()
+	return codecsByName[name]
+}
+
+// bufferedConn reads through the reader used for the handshake so that
+// nothing read ahead is lost
+type bufferedConn struct {
+	*bufio.Reader
+	io.WriteCloser
+}
+
+//Split a handshake line into its fields. The error field takes the rest
+func parseHandshake(line string) (int, map[string]string, error) {
+	line = strings.TrimRight(line, "\r\n")
+	if !strings.HasPrefix(line, handshakeMagic) {
+		return 0, nil, errors.New("Invalid handshake")
+	}
+	line = line[len(handshakeMagic):]
+	fields := make(map[string]string)
+	if pos := strings.Index(line, " error="); pos >= 0 {
+		fields["error"] = line[pos+len(" error="):]
+		line = line[:pos]
+	}
+	parts := strings.Fields(line)
+	if len(parts) == 0 {
+		return 0, nil, errors.New("Invalid handshake")
+	}
+	version, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, nil, errors.New("Invalid handshake version " + parts[0])
+	}
+	for _, part := range parts[1:] {
+		if kv := strings.SplitN(part, "=", 2); len(kv) == 2 {
+			fields[kv[0]] = kv[1]
+		}
+	}
+	return version, fields, nil
+}
+
+func readHandshake(reader *bufio.Reader) (int, map[string]string, error) {
+	line, err := reader.ReadSlice('\n')
+	if err != nil {
+		if err == bufio.ErrBufferFull {
+			err = errors.New("Handshake is too long")
+		}
+		return 0, nil, err
+	}
+	return parseHandshake(string(line))
+}
+
+//Build the codec for a negotiated codec and compression. The frames are returned for their stats
+func negotiatedCodec(stream io.ReadWriteCloser, codecName, compressionName string, config frameConfig) (Codec, *frameConn, error) {
+	codec := lookupCodec(codecName)
+	compression, ok := lookupCompression(compressionName)
+	if codec == nil || !ok {
+		return nil, nil, errors.New("Unknown codec " + codecName + " or compression " + compressionName)
+	}
+	config.scheme, config.compression = compressionName, compression
+	frames := newFrameConn(stream, config)
+	return codec(frames), frames, nil
+}
+
+//Names in allowed, or all of them if it is nil
+func isAllowed(allowed []string, name string) bool {
+	if allowed == nil {
+		return true
+	}
+	for _, allowedName := range allowed {
+		if allowedName == name {
+			return true
+		}
+	}
+	return false
+}
+
+// handshake sets up the codec of a connection. Peers that do not start with
+// a handshake get the codec set with CodecFunc once they send something or
+// the handshake timeout expires, so that clients that only wait for pushes
+// are served.
+func (server *Server) handshake(conn io.ReadWriteCloser) (Codec, *frameConn, error) {
+	server.lock.Lock()
+	required, timeout := server.requireHandshake, server.handshakeTimeout
+	allowedCodecs, allowedCompressions := server.codecs, server.compressions
+	server.lock.Unlock()
+	if deadliner, ok := conn.(interface{ SetReadDeadline(time.Time) error }); ok && timeout > 0 {
+		deadliner.SetReadDeadline(time.Now().Add(timeout))
+		defer deadliner.SetReadDeadline(time.Time{})
+	}
+	reader := bufio.NewReader(conn)
+	stream := &bufferedConn{reader, conn}
+	peek, err := reader.Peek(len(handshakeMagic))
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() && (len(peek) == 0 || !strings.HasPrefix(handshakeMagic, string(peek))) {
+		err = nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if string(peek) != handshakeMagic {
+		if required {
+			return nil, nil, errors.New("Client did not start with a handshake")
+		}
+		return server.codecCB(stream), nil, nil
+	}
+	version, fields, err := readHandshake(reader)
+	reject := func(reason string) (Codec, *frameConn, error) {
+		io.WriteString(conn, handshakeMagic+strconv.Itoa(ProtocolVersion)+" error="+reason+"\n")
+		return nil, nil, errors.New("Rejected handshake: " + reason)
+	}
+	switch {
+	case err != nil:
+		return reject(err.Error())
+	case version != ProtocolVersion:
+		return reject("Unsupported protocol version " + strconv.Itoa(version))
+	}
+	codecName := ""
+	for _, name := range strings.Split(fields["codecs"], ",") {
+		if isAllowed(allowedCodecs, name) && lookupCodec(name) != nil {
+			codecName = name
+			break
+		}
+	}
+	if codecName == "" {
+		return reject("No common codec in " + fields["codecs"])
+	}
+	compressionName := ""
+	for _, name := range strings.Split(fields["compression"], ",") {
+		if _, ok := lookupCompression(name); ok && isAllowed(allowedCompressions, name) {
+			compressionName = name
+			break
+		}
+	}
+	if compressionName == "" {
+		return reject("No common compression in " + fields["compression"])
+	}
+	if _, err := io.WriteString(conn, handshakeMagic+strconv.Itoa(ProtocolVersion)+" codec="+codecName+" compression="+compressionName+"\n"); err != nil {
+		return nil, nil, err
+	}
+	server.lock.Lock()
+	config := frameConfig{
+		level:         server.compressLevel,
+		threshold:     server.compressThreshold,
+		maxHeaderSize: server.maxHeaderSize,
+		maxBodySize:   server.maxBodySize,
+	}
+	server.lock.Unlock()
+	return negotiatedCodec(stream, codecName, compressionName, config)
+}
+
+// RequireHandshake makes the server close the connections that do not start
+// with a handshake instead of serving them with the codec set with CodecFunc.
+// Their messages are not framed so their size cannot be limited.
+func (server *Server) RequireHandshake(required bool) {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	server.requireHandshake = required
+}
+
+// SetHandshakeTimeout sets how long the server waits for a client to start
+// the handshake. Clients that send nothing meanwhile are served with the
+// codec set with CodecFunc, or closed if RequireHandshake is set. It also
+// limits the TLS handshake of the connections accepted with AcceptTLS. A
+// value of 0 waits until the client sends something, so the connection is not
+// listed or reachable until then.
+func (server *Server) SetHandshakeTimeout(timeout time.Duration) {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	server.handshakeTimeout = timeout
+}
+
+// SetCodecs limits the codecs the server accepts in the handshake to the
+// given registered ones. No names accept all the registered codecs.
+func (server *Server) SetCodecs(names ...string) {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	server.codecs = nil
+	if len(names) > 0 {
+		server.codecs = append([]string(nil), names...)
+	}
+}
+
+// SetCompressions limits the compressions the server accepts in the
+// handshake to the given ones. Leaving out "none" makes clients compress. No
+// names accept all the registered compressions.
+func (server *Server) SetCompressions(names ...string) {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	server.compressions = nil
+	if len(names) > 0 {
+		server.compressions = append([]string(nil), names...)
+	}
+}
+
+//Propose the codecs and compressions of hs and build the codec the server picks
+func clientHandshake(conn io.ReadWriteCloser, hs Handshake) (Codec, error) {
+	compression := hs.Compression
+	if len(compression) == 0 {
+		compression = []string{noCompression}
+	}
+	proposal := handshakeMagic + strconv.Itoa(ProtocolVersion) +
+		" codecs=" + strings.Join(hs.Codecs, ",") +
+		" compression=" + strings.Join(compression, ",") + "\n"
+	if _, err := io.WriteString(conn, proposal); err != nil {
+		return nil, err
+	}
+	//Servers that do not know the handshake never answer
+	if deadliner, ok := conn.(interface{ SetReadDeadline(time.Time) error }); ok {
+		timeout := hs.Timeout
+		if timeout <= 0 {
+			timeout = DefaultHandshakeTimeout
+		}
+		deadliner.SetReadDeadline(time.Now().Add(timeout))
+		defer deadliner.SetReadDeadline(time.Time{})
+	}
+	reader := bufio.NewReader(conn)
+	version, fields, err := readHandshake(reader)
+	switch {
+	case err != nil:
+		return nil, errors.New("Reading handshake: " + err.Error())
+	case fields["error"] != "":
+		return nil, ServerError("Handshake rejected by server: " + fields["error"])
+	case version != ProtocolVersion:
+		return nil, errors.New("Unsupported protocol version " + strconv.Itoa(version))
+	}
+	config := frameConfig{level: hs.Level, threshold: hs.Threshold, maxHeaderSize: hs.MaxHeaderSize, maxBodySize: hs.MaxBodySize}
+	codec, _, err := negotiatedCodec(&bufferedConn{reader, conn}, fields["codec"], fields["compression"], config)
+	return codec, err
+}
+
+// NewClientHandshake agrees with the server on the codec and compression to
+// use and creates a client that uses them.
+func NewClientHandshake(conn io.ReadWriteCloser, hs Handshake) (*Client, error) {
+	return newHandshakeClient(conn, hs, new(CallbackManager), nil)
+}
+
+func newHandshakeClient(conn io.ReadWriteCloser, hs Handshake, cbmgr *CallbackManager, registry *Registry) (*Client, error) {
+	codec, err := clientHandshake(conn, hs)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return newConnClient(conn, codec, cbmgr, registry), nil
+}
@@ -0,0 +1,172 @@
+package clacks
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHandshake(t *testing.T) {
+	_, addr := startAcceptServer(t, new(DummyService))
+	for _, codec := range []string{"gob", "json", "msgpack"} {
+		for _, compression := range []string{"flate", "gzip", "none"} {
+			conn, err := net.Dial("tcp", addr)
+			if err != nil {
+				t.Fatal("dialing", err)
+			}
+			hs := Handshake{Codecs: []string{"bogus", codec}, Compression: []string{"bogus", compression}}
+			client, err := NewClientHandshake(conn, hs)
+			if err != nil {
+				t.Fatal(codec, compression, err)
+			}
+			reply := new(Reply)
+			if err := client.Call("DummyService.Sum", Args{1, 2}, reply); err != nil || reply.Num != 3 {
+				t.Error(codec, compression, "call failed", err, reply.Num)
+			}
+			client.Close()
+		}
+	}
+
+	//Clients without handshake get the default codec
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("dialing", err)
+	}
+	client := NewClient(conn)
+	defer client.Close()
+	reply := new(Reply)
+	if err := client.Call("DummyService.Sum", Args{3, 2}, reply); err != nil || reply.Num != 5 {
+		t.Error("Call without handshake failed", err, reply.Num)
+	}
+}
+
+func TestHandshakeReject(t *testing.T) {
+	_, addr := startAcceptServer(t, new(DummyService))
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("dialing", err)
+	}
+	_, err = NewClientHandshake(conn, Handshake{Codecs: []string{"bogus"}})
+	if err == nil || !strings.Contains(err.Error(), "No common codec in bogus") {
+		t.Error("Expected the codec to be rejected and got", err)
+	}
+
+	conn, err = net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("dialing", err)
+	}
+	defer conn.Close()
+	io.WriteString(conn, "CLACKS/3 codecs=gob compression=none\n")
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if line != "CLACKS/2 error=Unsupported protocol version 3\n" {
+		t.Error("Unexpected handshake reply", line)
+	}
+}
+
+func TestHandshakeTimeout(t *testing.T) {
+	srv, addr := startAcceptServer(t, new(DummyService))
+	srv.SetHandshakeTimeout(20 * time.Millisecond)
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("dialing", err)
+	}
+	//The client only waits for pushes so it never sends anything
+	client := NewClient(conn)
+	defer client.Close()
+	received := make(chan PushData, 1)
+	if err := client.SubscribeToPush(func(pd PushData) { received <- pd }); err != nil {
+		t.Fatal(err)
+	}
+	var conns []ConnectionInfo
+	for i := 0; i < 100 && len(conns) == 0; i++ {
+		time.Sleep(5 * time.Millisecond)
+		conns = srv.Connections()
+	}
+	if len(conns) != 1 {
+		t.Fatal("Expected the connection to be listed and got", conns)
+	}
+	if err := srv.Push(conns[0].ClientId, PushData{1, 2}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case pd := <-received:
+		if pd.A != 1 || pd.B != 2 {
+			t.Error("Unexpected push", pd)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Push was not received")
+	}
+}
+
+func TestHandshakeAllowList(t *testing.T) {
+	srv, addr := startAcceptServer(t, new(DummyService))
+	srv.SetCodecs("msgpack")
+	srv.SetCompressions("gzip")
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("dialing", err)
+	}
+	_, err = NewClientHandshake(conn, Handshake{Codecs: []string{"gob", "json"}})
+	if err == nil || !strings.Contains(err.Error(), "No common codec in gob,json") {
+		t.Error("Expected the codecs to be rejected and got", err)
+	}
+	conn, err = net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("dialing", err)
+	}
+	_, err = NewClientHandshake(conn, Handshake{Codecs: []string{"msgpack"}, Compression: []string{"flate", "none"}})
+	if err == nil || !strings.Contains(err.Error(), "No common compression in flate,none") {
+		t.Error("Expected the compressions to be rejected and got", err)
+	}
+	conn, err = net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("dialing", err)
+	}
+	client, err := NewClientHandshake(conn, Handshake{Codecs: []string{"gob", "msgpack"}, Compression: []string{"flate", "gzip"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	reply := new(Reply)
+	if err := client.Call("DummyService.Sum", Args{1, 2}, reply); err != nil || reply.Num != 3 {
+		t.Error("call failed", err, reply.Num)
+	}
+}
+
+func TestClientHandshakeTimeout(t *testing.T) {
+	//A server that accepts the connection but never answers
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen tcp :0: %v", err)
+	}
+	defer l.Close()
+	go func() {
+		if conn, err := l.Accept(); err == nil {
+			defer conn.Close()
+			io.Copy(io.Discard, conn)
+		}
+	}()
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal("dialing", err)
+	}
+	done := make(chan error, 1)
+	go func() {
+		_, err := NewClientHandshake(conn, Handshake{Codecs: []string{"gob"}, Timeout: 20 * time.Millisecond})
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err == nil || !strings.Contains(err.Error(), "Reading handshake") {
+			t.Error("Expected the handshake to time out and got", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Handshake did not time out")
+	}
+}
@@ -0,0 +1,126 @@
+package clacks
+
+import (
+	"reflect"
+)
+
+// Handler runs a call to a "Service.Method" with the arguments sent by the
+// client. It returns the values sent back, the pointer arguments followed by
+// the values the method returned, and the error of the call.
+type Handler func(ctx *Context, method string, args []reflect.Value) ([]reflect.Value, error)
+
+// Interceptor wraps the calls made to the services of a server. It can
+// inspect or modify the arguments before calling next, return an error
+// without calling it, and look at or change what next returns. Arguments
+// have to keep the types the method expects.
+type Interceptor func(ctx *Context, method string, args []reflect.Value, next Handler) ([]reflect.Value, error)
+
+// Use adds interceptors to the calls made to the services of the server,
+// built-in ones included. The first interceptor added is the first one to
+// run.
+func (server *Server) Use(interceptors ...Interceptor) {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	server.interceptors = append(server.interceptors, interceptors...)
+}
+
+//Wrap a handler with the interceptors of the server
+func (server *Server) intercept(handler Handler) Handler {
+	server.lock.Lock()
+	interceptors := server.interceptors
+	server.lock.Unlock()
+	for iPos := len(interceptors) - 1; iPos >= 0; iPos-- {
+		interceptor, next := interceptors[iPos], handler
+		handler = func(ctx *Context, method string, args []reflect.Value) ([]reflect.Value, error) {
+			return interceptor(ctx, method, args, next)
+		}
+	}
+	return handler
+}
+
+// Invoker sends a call and waits for it to complete. It returns the error of
+// the call and leaves the values returned by the method in call.Results.
+type Invoker func(call *Call) error
+
+// ClientInterceptor wraps the calls made with Go, Call and Invoke. It can
+// change the method or arguments of the call or add metadata to it before
+// calling next, time it, call next again to retry, return an error without
+// calling it, and look at or change the results. Streaming calls are not
+// intercepted.
+type ClientInterceptor func(call *Call, next Invoker) error
+
+// PushHandler delivers a value pushed by the server to the callbacks
+// subscribed to it. The topic is empty for values pushed to the client.
+type PushHandler func(topic string, value interface{})
+
+// PushInterceptor sees the values pushed by the server before the callbacks
+// do. It can change the value or drop it by not calling next.
+type PushInterceptor func(topic string, value interface{}, next PushHandler)
+
+// Use adds interceptors to the calls made by the client. The first
+// interceptor added is the first one to run.
+func (client *Client) Use(interceptors ...ClientInterceptor) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	client.interceptors = append(client.interceptors, interceptors...)
+}
+
+// UsePush adds interceptors to the values pushed by the server. The first
+// interceptor added is the first one to run.
+func (client *Client) UsePush(interceptors ...PushInterceptor) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	client.pushInterceptors = append(client.pushInterceptors, interceptors...)
+}
+
+//Replace the interceptors of the client, like a ReconnectingClient does with
+//the clients it creates
+func (client *Client) setInterceptors(interceptors []ClientInterceptor, pushInterceptors []PushInterceptor) {
+	client.mutex.Lock()
+	defer client.mutex.Unlock()
+	client.interceptors = append([]ClientInterceptor(nil), interceptors...)
+	client.pushInterceptors = append([]PushInterceptor(nil), pushInterceptors...)
+}
+
+//Wrap sending a call with the interceptors of the client. It returns nil if
+//there are none
+func (client *Client) interceptCall() Invoker {
+	client.mutex.Lock()
+	interceptors := client.interceptors
+	client.mutex.Unlock()
+	if len(interceptors) == 0 {
+		return nil
+	}
+	invoker := client.invoke
+	for iPos := len(interceptors) - 1; iPos >= 0; iPos-- {
+		interceptor, next := interceptors[iPos], invoker
+		invoker = func(call *Call) error {
+			return interceptor(call, next)
+		}
+	}
+	return invoker
+}
+
+//Send a call and wait for it. The call can be sent again, like on a retry
+func (client *Client) invoke(call *Call) error {
+	sent := &Call{Method: call.Method, Args: call.Args, Metadata: call.Metadata, Done: make(chan *Call, 1)}
+	client.send(sent)
+	<-sent.Done
+	call.Error = sent.Error
+	call.Results = sent.Results
+	return call.Error
+}
+
+//Wrap delivering a push with the interceptors of the client
+func (client *Client) interceptPush(handler PushHandler) PushHandler {
+	client.mutex.Lock()
+	interceptors := client.pushInterceptors
+	client.mutex.Unlock()
+	for iPos := len(interceptors) - 1; iPos >= 0; iPos-- {
+		interceptor, next := interceptors[iPos], handler
+		handler = func(topic string, value interface{}) {
+			interceptor(topic, value, next)
+		}
+	}
+	return handler
+}
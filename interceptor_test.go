@@ -0,0 +1,214 @@
+package clacks
+
+import (
+	"errors"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestInterceptors(t *testing.T) {
+	srv, addr := startAcceptServer(t, new(DummyService), new(ResultService))
+	var lock sync.Mutex
+	seen := make([]string, 0)
+	srv.Use(func(ctx *Context, method string, args []reflect.Value, next Handler) ([]reflect.Value, error) {
+		lock.Lock()
+		seen = append(seen, method)
+		lock.Unlock()
+		return next(ctx, method, args)
+	}, func(ctx *Context, method string, args []reflect.Value, next Handler) ([]reflect.Value, error) {
+		if method == "DummyService.Error" {
+			return nil, errors.New("Not allowed")
+		}
+		return next(ctx, method, args)
+	})
+	//Later interceptors run closer to the method
+	srv.Use(func(ctx *Context, method string, args []reflect.Value, next Handler) ([]reflect.Value, error) {
+		if method != "DummyService.Sum" {
+			return next(ctx, method, args)
+		}
+		a := args[0].Interface().(Args)
+		args[0] = reflect.ValueOf(Args{a.A * 10, a.B * 10})
+		rargs, err := next(ctx, method, args)
+		if err == nil {
+			rargs[0].Interface().(*Reply).Num += 1
+		}
+		return rargs, err
+	})
+	client, err := Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("dialing", err)
+	}
+	defer client.Close()
+	client.RegisterType(Reply{})
+	rep := &Reply{}
+	if err = client.Call("DummyService.Sum", Args{1, 2}, rep); err != nil {
+		t.Fatal(err)
+	}
+	if rep.Num != 31 {
+		t.Error("Expected the interceptor to change the arguments and reply and got", rep.Num)
+	}
+	if err = client.Call("DummyService.Error", Args{1, 2}, rep); err == nil || err.Error() != "Not allowed" {
+		t.Error("Expected the interceptor to stop the call and got", err)
+	}
+	results, err := client.Invoke("ResultService.Divide", Args{7, 2})
+	if err != nil || !reflect.DeepEqual(results, []interface{}{Reply{3}}) {
+		t.Errorf("Unexpected results %#v %v", results, err)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if !reflect.DeepEqual(seen, []string{"DummyService.Sum", "DummyService.Error", "ResultService.Divide"}) {
+		t.Error("Unexpected calls seen", seen)
+	}
+}
+
+func TestClientInterceptors(t *testing.T) {
+	_, addr := startAcceptServer(t, new(DummyService), new(PushService))
+	client, err := Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("dialing", err)
+	}
+	defer client.Close()
+	var lock sync.Mutex
+	attempts := make(map[string]int)
+	client.Use(func(call *Call, next Invoker) error {
+		if call.Method == "Blocked.Method" {
+			return errors.New("Not sent")
+		}
+		return next(call)
+	}, func(call *Call, next Invoker) error {
+		//Retry once
+		lock.Lock()
+		attempts[call.Method]++
+		lock.Unlock()
+		if err := next(call); err == nil || call.Method != "DummyService.Error" {
+			return err
+		}
+		lock.Lock()
+		attempts[call.Method]++
+		lock.Unlock()
+		return next(call)
+	}, func(call *Call, next Invoker) error {
+		if call.Method == "DummyService.Add" {
+			call.Method = "DummyService.Sum"
+		}
+		return next(call)
+	})
+	rep := &Reply{}
+	if err = client.Call("DummyService.Add", Args{1, 2}, rep); err != nil || rep.Num != 3 {
+		t.Error("Expected the interceptor to rename the method and got", rep.Num, err)
+	}
+	if err = client.Call("DummyService.Error", Args{1, 2}, rep); err == nil || err.Error() != "Test Error" {
+		t.Error("Expected the error of the method and got", err)
+	}
+	if err = client.Call("Blocked.Method"); err == nil || err.Error() != "Not sent" {
+		t.Error("Expected the interceptor to stop the call and got", err)
+	}
+	lock.Lock()
+	if attempts["DummyService.Add"] != 1 || attempts["DummyService.Error"] != 2 || attempts["Blocked.Method"] != 0 {
+		t.Error("Unexpected attempts", attempts)
+	}
+	lock.Unlock()
+
+	received := make(chan PushData, 2)
+	if err = client.SubscribeToPush(func(pd PushData) { received <- pd }); err != nil {
+		t.Fatal(err)
+	}
+	client.UsePush(func(topic string, value interface{}, next PushHandler) {
+		if pd, ok := value.(PushData); ok && pd.B != 0 {
+			next(topic, PushData{pd.A * 10, pd.B})
+		}
+	})
+	if err = client.Call("PushService.PushMe", Args{1, 0}); err != nil {
+		t.Fatal(err)
+	}
+	if err = client.Call("PushService.PushMe", Args{1, 2}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case pd := <-received:
+		if pd.A != 10 || pd.B != 2 {
+			t.Error("Expected the interceptor to change the push and got", pd)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Push was not received")
+	}
+	select {
+	case pd := <-received:
+		t.Error("Expected the interceptor to drop the push and got", pd)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestCallMetadata(t *testing.T) {
+	for name, codecFunc := range map[string]codecFunc{"gob": GenerateGobCodec, "json": GenerateJSONCodec, "msgpack": GenerateMsgpackCodec} {
+		srv, addr := startAcceptServer(t, new(DummyService))
+		srv.CodecFunc(codecFunc)
+		seen := make(chan string, 1)
+		srv.Use(func(ctx *Context, method string, args []reflect.Value, next Handler) ([]reflect.Value, error) {
+			seen <- ctx.GetMetadata("trace")
+			return next(ctx, method, args)
+		})
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal("dialing", err)
+		}
+		client := NewClientWithCodec(codecFunc(conn))
+		client.Use(func(call *Call, next Invoker) error {
+			if call.Metadata == nil {
+				call.Metadata = make(map[string]string)
+			}
+			call.Metadata["trace"] = "abc"
+			return next(call)
+		})
+		rep := &Reply{}
+		if err = client.Call("DummyService.Sum", Args{1, 2}, rep); err != nil || rep.Num != 3 {
+			t.Error(name, "Unexpected reply", rep.Num, err)
+		}
+		if trace := <-seen; trace != "abc" {
+			t.Errorf("%s: Expected the metadata of the call and got %q", name, trace)
+		}
+		client.Close()
+	}
+}
+
+func TestReconnectingClientInterceptors(t *testing.T) {
+	_, addr := startAcceptServer(t, new(DummyService))
+	dialer := &connDialer{addr: addr}
+	rc, err := NewReconnectingClient(dialer.dial, ReconnectPolicy{MinBackoff: time.Millisecond, MaxBackoff: 10 * time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	var lock sync.Mutex
+	calls := 0
+	rc.Use(func(call *Call, next Invoker) error {
+		lock.Lock()
+		calls++
+		lock.Unlock()
+		return next(call)
+	})
+	rep := &Reply{}
+	if err = rc.Call("DummyService.Sum", Args{1, 2}, rep); err != nil || rep.Num != 3 {
+		t.Fatal("Calling DummyService.Sum:", rep.Num, err)
+	}
+	//New clients get the interceptors too
+	reconnected := make(chan *Client, 1)
+	rc.SubscribeToReconnect(func(c *Client) { reconnected <- c })
+	dialer.breakConn()
+	select {
+	case <-reconnected:
+	case <-time.After(time.Second):
+		t.Fatal("Did not reconnect")
+	}
+	if err = rc.Call("DummyService.Sum", Args{2, 2}, rep); err != nil || rep.Num != 4 {
+		t.Fatal("Calling DummyService.Sum:", rep.Num, err)
+	}
+	lock.Lock()
+	defer lock.Unlock()
+	if calls != 2 {
+		t.Error("Expected the interceptor to see 2 calls and saw", calls)
+	}
+}
@@ -0,0 +1,106 @@
+package clacks
+
+import (
+	"reflect"
+	"sort"
+)
+
+const introspectionServiceName = "Clacks"
+
+// ArgumentInfo describes an argument of a method.
+type ArgumentInfo struct {
+	Type    string // name the type travels with
+	Pointer bool   // the value is sent back in the reply
+}
+
+// MethodInfo describes a method so that clients can call it without reading
+// the source of the server.
+type MethodInfo struct {
+	Service    string
+	Method     string
+	Args       []ArgumentInfo // arguments after the *Context
+	Results    []string       // types of the values returned before the error
+	Stream     bool           // the method sends values with a *Stream
+	RecvStream bool           // the method reads values with a *RecvStream
+}
+
+// Introspection is the built-in service that describes what a server
+// exposes. It is registered in every server under the name Clacks.
+type Introspection struct {
+	server *Server
+}
+
+//List the names of the services registered in the server
+func (in *Introspection) ListServices(ctx *Context, services *[]string) error {
+	*services = in.server.getRegistry().serviceNames()
+	return nil
+}
+
+//List the names of the methods of a service
+func (in *Introspection) ListMethods(ctx *Context, service string, methods *[]string) error {
+	names, err := in.server.getRegistry().methodNames(service)
+	if err != nil {
+		return err
+	}
+	*methods = names
+	return nil
+}
+
+//Describe the arguments and results of a "Service.Method"
+func (in *Introspection) DescribeMethod(ctx *Context, serviceMethod string, info *MethodInfo) error {
+	described, err := in.server.getRegistry().describe(serviceMethod)
+	if err != nil {
+		return err
+	}
+	*info = described
+	return nil
+}
+
+func (registry *Registry) serviceNames() []string {
+	registry.lock.RLock()
+	defer registry.lock.RUnlock()
+	names := make([]string, 0, len(registry.svcMap))
+	for name := range registry.svcMap {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (registry *Registry) methodNames(service string) ([]string, error) {
+	registry.lock.RLock()
+	defer registry.lock.RUnlock()
+	svcData, ok := registry.svcMap[service]
+	if !ok {
+		return nil, NewError(CodeNotFound, "Can't find service "+service)
+	}
+	names := make([]string, 0, len(svcData.methods))
+	for name := range svcData.methods {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (registry *Registry) describe(serviceMethod string) (MethodInfo, error) {
+	svcData, mData, err := registry.lookup(serviceMethod)
+	if err != nil {
+		return MethodInfo{}, err
+	}
+	types := registry.getTypes()
+	info := MethodInfo{
+		Service:    svcData.name,
+		Method:     mData.method.Name,
+		Args:       make([]ArgumentInfo, len(mData.args)),
+		Results:    make([]string, len(mData.results)),
+		Stream:     mData.stream,
+		RecvStream: mData.recvStream,
+	}
+	for iPos, mArg := range mData.args {
+		info.Args[iPos] = ArgumentInfo{Type: types.nameOf(mArg.typ), Pointer: mArg.typ.Kind() == reflect.Ptr}
+	}
+	for iPos, typ := range mData.results {
+		info.Results[iPos] = types.nameOf(typ)
+	}
+	return info, nil
+}
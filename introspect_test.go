@@ -0,0 +1,62 @@
+package clacks
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestIntrospection(t *testing.T) {
+	_, addr := startAcceptServer(t, new(ResultService), new(StreamService))
+	for _, codec := range []string{"gob", "json", "msgpack"} {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal("dialing", err)
+		}
+		client, err := NewClientHandshake(conn, Handshake{Codecs: []string{codec}})
+		if err != nil {
+			t.Fatal(codec, err)
+		}
+		var services []string
+		if err = client.Call("Clacks.ListServices", &services); err != nil {
+			t.Fatal(codec, err)
+		}
+		if !reflect.DeepEqual(services, []string{"Clacks", "PubSub", "ResultService", "StreamService"}) {
+			t.Error(codec, "Unexpected services", services)
+		}
+		var methods []string
+		if err = client.Call("Clacks.ListMethods", "ResultService", &methods); err != nil {
+			t.Fatal(codec, err)
+		}
+		if !reflect.DeepEqual(methods, []string{"DivMod", "Divide", "Find"}) {
+			t.Error(codec, "Unexpected methods", methods)
+		}
+		if err = client.Call("Clacks.ListMethods", "Nops", &methods); err == nil || err.Error() != "Can't find service Nops" {
+			t.Error(codec, "Expected an error for an unknown service and got", err)
+		}
+		var info MethodInfo
+		if err = client.Call("Clacks.DescribeMethod", "ResultService.DivMod", &info); err != nil {
+			t.Fatal(codec, err)
+		}
+		expected := MethodInfo{
+			Service: "ResultService",
+			Method:  "DivMod",
+			Args:    []ArgumentInfo{{Type: "clacks.Args"}, {Type: "clacks.Reply", Pointer: true}},
+			Results: []string{"int", "string"},
+		}
+		if !reflect.DeepEqual(info, expected) {
+			t.Errorf("%s: Unexpected description %+v", codec, info)
+		}
+		info = MethodInfo{}
+		if err = client.Call("Clacks.DescribeMethod", "StreamService.Count", &info); err != nil {
+			t.Fatal(codec, err)
+		}
+		if !info.Stream || info.RecvStream || len(info.Results) != 0 {
+			t.Errorf("%s: Unexpected description %+v", codec, info)
+		}
+		if err = client.Call("Clacks.DescribeMethod", "ResultService.Nops", &info); err == nil {
+			t.Error(codec, "Expected an error for an unknown method")
+		}
+		client.Close()
+	}
+}
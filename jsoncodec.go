@@ -0,0 +1,158 @@
+package clacks
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"reflect"
+	"sync"
+)
+
+// jsonValue wraps the values that travel as an interface, like pushes and
+// stream data, so that the receiver knows which type to decode them into.
+type jsonValue struct {
+	Type  string          `json:"type"`
+	Value json.RawMessage `json:"value"`
+}
+
+// jsonCodec sends each header and body as a JSON document in its own line.
+// Bodies are only sent when they are not nil, like with the gob codec.
+type jsonCodec struct {
+	rwc       io.ReadWriteCloser
+	types     *TypeTable
+	dec       *json.Decoder
+	buf       *bufio.Reader // what dec reads from
+	enc       *json.Encoder
+	encBuf    *bufio.Writer
+	writeLock sync.Mutex
+}
+
+// GenerateJSONCodec creates a codec that speaks JSON over the connection. It
+// can be set with Server.CodecFunc and used with NewClientWithCodec.
+func GenerateJSONCodec(conn io.ReadWriteCloser) Codec {
+	codec := &jsonCodec{}
+	codec.SetRWC(conn)
+	return codec
+}
+
+func (c *jsonCodec) SetRWC(rwc io.ReadWriteCloser) {
+	c.rwc = rwc
+	c.types = NewTypeTable()
+	c.encBuf = bufio.NewWriter(rwc)
+	c.enc = json.NewEncoder(c.encBuf)
+	c.buf = bufio.NewReader(rwc)
+	c.dec = json.NewDecoder(c.buf)
+}
+
+func (c *jsonCodec) SetTypeTable(types *TypeTable) {
+	c.types = types
+}
+
+//Wrap the values sent as an interface with their type name
+func (c *jsonCodec) encodeBody(body interface{}) error {
+	iface, ok := body.(*interface{})
+	if !ok {
+		return c.enc.Encode(body)
+	}
+	value := reflect.ValueOf(*iface)
+	if !value.IsValid() {
+		return c.enc.Encode(nil)
+	}
+	raw, err := json.Marshal(*iface)
+	if err != nil {
+		return err
+	}
+	return c.enc.Encode(jsonValue{Type: c.types.nameOf(value.Type()), Value: raw})
+}
+
+func (c *jsonCodec) write(header interface{}, body interface{}) (err error) {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	if err = c.enc.Encode(header); err != nil {
+		return
+	}
+	if err = flushFrame(c.encBuf, c.rwc, FrameHeader); err != nil {
+		return
+	}
+	if body != nil {
+		if err = c.encodeBody(body); err != nil {
+			return
+		}
+		if err = flushFrame(c.encBuf, c.rwc, FrameBody); err != nil {
+			return
+		}
+	}
+	return c.encBuf.Flush()
+}
+
+func (c *jsonCodec) WriteRequest(r *Request, body interface{}) error {
+	return c.write(r, body)
+}
+
+func (c *jsonCodec) WriteResponse(r *Response, body interface{}) error {
+	return c.write(r, body)
+}
+
+//Close the frame of a header or body once it is read. The new line after
+//each document is not part of the next one
+func (c *jsonCodec) endRead(err error) error {
+	if _, ok := c.rwc.(*frameConn); !ok {
+		return err
+	}
+	buffered := c.buf.Buffered()
+	if rest, _ := io.ReadAll(c.dec.Buffered()); len(bytes.TrimSpace(rest)) > 0 {
+		buffered += len(rest)
+	}
+	if endErr := EndRead(c.rwc, buffered); err == nil {
+		err = endErr
+	}
+	return err
+}
+
+func (c *jsonCodec) ReadRequestHeader(r *Request) error {
+	return c.endRead(c.dec.Decode(r))
+}
+
+func (c *jsonCodec) ReadResponseHeader(r *Response) error {
+	return c.endRead(c.dec.Decode(r))
+}
+
+// ReadBody decodes the next body into body. Slices of interfaces have to be
+// filled with pointers to the expected types, the way readArguments does,
+// because JSON does not carry them. Values read into an empty interface
+// get the type they were sent with if it is registered.
+func (c *jsonCodec) ReadBody(body interface{}) error {
+	return c.endRead(c.readBody(body))
+}
+
+func (c *jsonCodec) readBody(body interface{}) error {
+	switch target := body.(type) {
+	case nil:
+		var discard json.RawMessage
+		return c.dec.Decode(&discard)
+	case *interface{}:
+		if *target != nil {
+			return c.dec.Decode(body)
+		}
+		var jv *jsonValue
+		if err := c.dec.Decode(&jv); err != nil || jv == nil {
+			return err
+		}
+		typ, ok := c.types.lookup(jv.Type)
+		if !ok {
+			return json.Unmarshal(jv.Value, target)
+		}
+		value := reflect.New(typ)
+		if err := json.Unmarshal(jv.Value, value.Interface()); err != nil {
+			return err
+		}
+		*target = value.Interface()
+		return nil
+	}
+	return c.dec.Decode(body)
+}
+
+func (c *jsonCodec) Close() error {
+	return c.rwc.Close()
+}
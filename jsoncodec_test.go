@@ -0,0 +1,127 @@
+package clacks
+
+import (
+	"bufio"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJSONCodec(t *testing.T) {
+	buf := RWCMock{}
+	codec := GenerateJSONCodec(&buf)
+	types := NewTypeTable()
+	types.Register(BodyData{})
+	codec.SetTypeTable(types)
+	req := Request{Type: R_RPC, Method: "A.B", Seq: 3}
+	resp := Response{Type: R_PUSH, Seq: 9, Topic: "news"}
+	data := BodyData{234234, "LOL"}
+	var pushed interface{} = data
+
+	if err := codec.WriteRequest(&req, []interface{}{data, 5}); err != nil {
+		t.Error(err)
+	}
+	if err := codec.WriteResponse(&resp, &pushed); err != nil {
+		t.Error(err)
+	}
+
+	readReq := new(Request)
+	if err := codec.ReadRequestHeader(readReq); err != nil {
+		t.Error(err)
+	}
+	ifaces := []interface{}{new(BodyData), new(int)}
+	if err := codec.ReadBody(&ifaces); err != nil {
+		t.Error(err)
+	}
+	if !reflect.DeepEqual(req, *readReq) {
+		t.Error("Requests are not the same")
+	}
+	if len(ifaces) != 2 || !reflect.DeepEqual(data, *ifaces[0].(*BodyData)) || *ifaces[1].(*int) != 5 {
+		t.Error("Request bodies are not the same", ifaces)
+	}
+
+	readResp := new(Response)
+	if err := codec.ReadResponseHeader(readResp); err != nil {
+		t.Error(err)
+	}
+	var readPush interface{}
+	if err := codec.ReadBody(&readPush); err != nil {
+		t.Error(err)
+	}
+	if !reflect.DeepEqual(resp, *readResp) {
+		t.Error("Response are not the same")
+	}
+	if body, ok := readPush.(*BodyData); !ok || !reflect.DeepEqual(data, *body) {
+		t.Error("Pushed values are not the same", readPush)
+	}
+}
+
+func startJSONServer(t *testing.T) string {
+	srv := NewServer()
+	srv.CodecFunc(GenerateJSONCodec)
+	srv.Register(new(DummyService))
+	srv.Register(new(PushService))
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen tcp :0: %v", err)
+	}
+	go srv.Accept(l)
+	return l.Addr().String()
+}
+
+func TestJSONClient(t *testing.T) {
+	conn, err := net.Dial("tcp", startJSONServer(t))
+	if err != nil {
+		t.Fatal("dialing", err)
+	}
+	client := NewClientWithCodec(GenerateJSONCodec(conn))
+	defer client.Close()
+	reply := new(Reply)
+	if err := client.Call("DummyService.Sum", Args{3, 4}, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.Num != 7 {
+		t.Error("Expected 7 and got", reply.Num)
+	}
+	if err := client.Call("DummyService.Error", Args{}, reply); err == nil || err.Error() != "Test Error" {
+		t.Error("Unexpected error", err)
+	}
+	received := make(chan PushData, 1)
+	if err := client.SubscribeToPush(func(pd PushData) { received <- pd }); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Call("PushService.PushMe", Args{5, 6}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case pd := <-received:
+		if pd.A != 5 || pd.B != 6 {
+			t.Error("Pushed data differs", pd)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Push was not received")
+	}
+}
+
+func TestJSONWire(t *testing.T) {
+	conn, err := net.Dial("tcp", startJSONServer(t))
+	if err != nil {
+		t.Fatal("dialing", err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write([]byte(`{"type":0,"method":"DummyService.Sum","seq":1}` + "\n" + `[{"A":1,"B":2},{}]` + "\n")); err != nil {
+		t.Fatal(err)
+	}
+	reader := bufio.NewReader(conn)
+	for _, expected := range []string{`{"type":0,"seq":1}`, `[{"Num":3}]`} {
+		line, err := reader.ReadString('\n')
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.TrimSpace(line) != expected {
+			t.Error("Expected", expected, "and got", line)
+		}
+	}
+}
@@ -0,0 +1,397 @@
+package clacks
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"reflect"
+	"strconv"
+	"sync"
+)
+
+// Error codes defined by JSON-RPC 2.0
+const (
+	JSONRPCParseError     = -32700
+	JSONRPCInvalidRequest = -32600
+	JSONRPCMethodNotFound = -32601
+	JSONRPCInvalidParams  = -32602
+	JSONRPCInternalError  = -32603
+	JSONRPCServerError    = -32000 //Errors returned by the methods
+)
+
+const jsonRPCVersion = "2.0"
+
+// JSONRPCError is the error object of a JSON-RPC 2.0 response
+type JSONRPCError struct {
+	Code    int         `json:"code"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+// jsonRPCErrorData is the data of the errors sent with a code, like the ones
+// made with NewError
+type jsonRPCErrorData struct {
+	Code      string       `json:"code"`
+	Retryable bool         `json:"retryable,omitempty"`
+	Causes    []ErrorCause `json:"causes,omitempty"`
+	Detail    interface{}  `json:"detail,omitempty"`
+}
+
+// jsonRPCMessage is anything a JSON-RPC peer sends. Requests and
+// notifications have a method. Responses to a R_CALL have a result or error.
+type jsonRPCMessage struct {
+	Version string          `json:"jsonrpc"`
+	Method  string          `json:"method,omitempty"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	Id      json.RawMessage `json:"id,omitempty"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *JSONRPCError   `json:"error,omitempty"`
+	batch   *jsonRPCBatch
+}
+
+type jsonRPCResponse struct {
+	Version string           `json:"jsonrpc"`
+	Result  *json.RawMessage `json:"result,omitempty"`
+	Error   *JSONRPCError    `json:"error,omitempty"`
+	Id      json.RawMessage  `json:"id"`
+}
+
+// jsonRPCRequest is sent to the client. Notifications have no id
+type jsonRPCRequest struct {
+	Version string      `json:"jsonrpc"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params,omitempty"`
+	Id      *uint64     `json:"id,omitempty"` //Only set for R_CALL
+}
+
+// jsonRPCPush is the params of the push notifications sent to the clients
+type jsonRPCPush struct {
+	Topic   string      `json:"topic,omitempty"`
+	PushSeq uint64      `json:"pushSeq,omitempty"`
+	Value   interface{} `json:"value"`
+}
+
+// jsonRPCData is the params of the notifications sent by streaming methods
+type jsonRPCData struct {
+	Id    json.RawMessage `json:"id"`
+	Value interface{}     `json:"value"`
+}
+
+// jsonRPCBatch collects the responses of a batch until all are written
+type jsonRPCBatch struct {
+	remaining int
+	responses []json.RawMessage
+}
+
+type jsonRPCPending struct {
+	id     json.RawMessage
+	notify bool // notifications get no response
+	batch  *jsonRPCBatch
+}
+
+var jsonRPCNullId = json.RawMessage("null")
+
+// jsonRPCCodec lets JSON-RPC 2.0 clients call the methods of a Server. Each
+// request gets a sequence that is mapped back to its id when replying.
+// Pushes, stream values and disconnections are sent as the notifications
+// push, data and close. Methods registered in the client are called with
+// requests whose id is the sequence of the call.
+type jsonRPCCodec struct {
+	rwc       io.ReadWriteCloser
+	dec       *json.Decoder
+	encBuf    *bufio.Writer
+	enc       *json.Encoder
+	writeLock sync.Mutex
+	// Only used by the reading goroutine
+	queue   []*jsonRPCMessage // requests of a batch waiting to be read
+	current *jsonRPCMessage   // message whose body is read next
+	// protects following
+	lock    sync.Mutex
+	seq     uint64
+	pending map[uint64]*jsonRPCPending
+}
+
+// GenerateJSONRPCCodec creates a server codec that speaks JSON-RPC 2.0. Set it
+// with Server.CodecFunc. Methods are called as "Service.Method" with the
+// arguments as positional params. Pointer arguments at the end can be left
+// out. The result is the value of the only pointer argument, or an array if
+// there are several.
+func GenerateJSONRPCCodec(conn io.ReadWriteCloser) Codec {
+	c := &jsonRPCCodec{
+		rwc:     conn,
+		dec:     json.NewDecoder(bufio.NewReader(conn)),
+		encBuf:  bufio.NewWriter(conn),
+		pending: make(map[uint64]*jsonRPCPending),
+	}
+	c.enc = json.NewEncoder(c.encBuf)
+	return c
+}
+
+//JSON-RPC values carry no type
+func (c *jsonRPCCodec) SetTypeTable(types *TypeTable) {}
+
+func (c *jsonRPCCodec) WriteRequest(r *Request, body interface{}) error {
+	return errors.New("JSON-RPC codec can only be used by servers")
+}
+
+func (c *jsonRPCCodec) ReadResponseHeader(r *Response) error {
+	return errors.New("JSON-RPC codec can only be used by servers")
+}
+
+//Get the JSON-RPC code for the code of an error sent by the server
+func jsonRPCErrorCode(code string) int {
+	switch ErrorCode(code) {
+	case CodeUnknownMethod:
+		return JSONRPCMethodNotFound
+	case CodeInvalidArgument:
+		return JSONRPCInvalidParams
+	}
+	return JSONRPCServerError
+}
+
+func (c *jsonRPCCodec) send(msg interface{}) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	if err := c.enc.Encode(msg); err != nil {
+		return err
+	}
+	return c.encBuf.Flush()
+}
+
+//Send a response or add it to its batch. Batches are sent once complete
+func (c *jsonRPCCodec) respond(batch *jsonRPCBatch, resp *jsonRPCResponse) error {
+	if batch == nil {
+		return c.send(resp)
+	}
+	data, err := json.Marshal(resp)
+	if err != nil {
+		return err
+	}
+	c.lock.Lock()
+	batch.responses = append(batch.responses, data)
+	batch.remaining--
+	complete := batch.remaining <= 0
+	c.lock.Unlock()
+	if !complete {
+		return nil
+	}
+	return c.send(batch.responses)
+}
+
+func (c *jsonRPCCodec) respondError(batch *jsonRPCBatch, id json.RawMessage, code int, msg string) error {
+	if id == nil {
+		id = jsonRPCNullId
+	}
+	return c.respond(batch, &jsonRPCResponse{Version: jsonRPCVersion, Error: &JSONRPCError{Code: code, Message: msg}, Id: id})
+}
+
+func (c *jsonRPCCodec) WriteResponse(r *Response, body interface{}) error {
+	switch r.Type {
+	case R_RPC:
+		c.lock.Lock()
+		pending := c.pending[r.Seq]
+		delete(c.pending, r.Seq)
+		c.lock.Unlock()
+		if pending == nil {
+			pending = &jsonRPCPending{id: jsonRPCNullId}
+		}
+		if pending.notify {
+			return nil
+		}
+		if r.Error != "" {
+			rpcErr := &JSONRPCError{Code: jsonRPCErrorCode(r.Code), Message: r.Error}
+			if r.Code != "" {
+				rpcErr.Data = &jsonRPCErrorData{Code: r.Code, Retryable: r.Retryable, Causes: r.Causes, Detail: body}
+			}
+			return c.respond(pending.batch, &jsonRPCResponse{Version: jsonRPCVersion, Error: rpcErr, Id: pending.id})
+		}
+		var result interface{}
+		if values, ok := body.([]interface{}); ok && len(values) == 1 {
+			result = values[0]
+		} else if len(values) > 1 {
+			result = values
+		}
+		data, err := json.Marshal(result)
+		if err != nil {
+			return c.respondError(pending.batch, pending.id, JSONRPCInternalError, err.Error())
+		}
+		raw := json.RawMessage(data)
+		return c.respond(pending.batch, &jsonRPCResponse{Version: jsonRPCVersion, Result: &raw, Id: pending.id})
+	case R_PUSH:
+		return c.send(&jsonRPCRequest{Version: jsonRPCVersion, Method: "push", Params: &jsonRPCPush{r.Topic, r.PushSeq, body}})
+	case R_DATA:
+		c.lock.Lock()
+		pending := c.pending[r.Seq]
+		c.lock.Unlock()
+		if pending == nil || pending.notify {
+			return nil
+		}
+		return c.send(&jsonRPCRequest{Version: jsonRPCVersion, Method: "data", Params: &jsonRPCData{pending.id, body}})
+	case R_CLOSE:
+		return c.send(&jsonRPCRequest{Version: jsonRPCVersion, Method: "close", Params: map[string]string{"reason": r.Error}})
+	case R_CALL:
+		seq := r.Seq
+		return c.send(&jsonRPCRequest{Version: jsonRPCVersion, Method: r.Method, Params: body, Id: &seq})
+	}
+	return nil
+}
+
+//Read the next message and queue the requests it contains
+func (c *jsonRPCCodec) readMessages() error {
+	var raw json.RawMessage
+	if err := c.dec.Decode(&raw); err != nil {
+		if _, ok := err.(*json.SyntaxError); ok {
+			//The stream can not be recovered from this
+			c.respondError(nil, nil, JSONRPCParseError, err.Error())
+			return io.ErrUnexpectedEOF
+		}
+		return err
+	}
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 || raw[0] != '[' {
+		if msg := parseJSONRPCMessage(raw); msg != nil {
+			c.queue = append(c.queue, msg)
+			return nil
+		}
+		return c.respondError(nil, nil, JSONRPCInvalidRequest, "Invalid Request")
+	}
+	var raws []json.RawMessage
+	json.Unmarshal(raw, &raws)
+	if len(raws) == 0 {
+		return c.respondError(nil, nil, JSONRPCInvalidRequest, "Invalid Request")
+	}
+	//Count the responses to wait for before any of them is written
+	batch := new(jsonRPCBatch)
+	msgs := make([]*jsonRPCMessage, len(raws))
+	for iPos, elem := range raws {
+		msgs[iPos] = parseJSONRPCMessage(elem)
+		if msgs[iPos] == nil || (msgs[iPos].Method != "" && msgs[iPos].Id != nil) {
+			batch.remaining++
+		}
+	}
+	for _, msg := range msgs {
+		if msg == nil {
+			c.respondError(batch, nil, JSONRPCInvalidRequest, "Invalid Request")
+			continue
+		}
+		msg.batch = batch
+		c.queue = append(c.queue, msg)
+	}
+	return nil
+}
+
+//Parse a request or a response. Returns nil if it is not valid
+func parseJSONRPCMessage(raw json.RawMessage) *jsonRPCMessage {
+	msg := new(jsonRPCMessage)
+	if err := json.Unmarshal(raw, msg); err != nil || msg.Version != jsonRPCVersion {
+		return nil
+	}
+	if msg.Method == "" && msg.Result == nil && msg.Error == nil {
+		return nil
+	}
+	return msg
+}
+
+func (c *jsonRPCCodec) ReadRequestHeader(r *Request) error {
+	for len(c.queue) == 0 {
+		if err := c.readMessages(); err != nil {
+			return err
+		}
+	}
+	msg := c.queue[0]
+	c.queue[0] = nil
+	c.queue = c.queue[1:]
+	c.current = msg
+	if msg.Method == "" {
+		//Reply to a R_CALL
+		r.Type = R_REPLY
+		//Ids of the calls are their sequence. Others can not be matched to a call
+		seq, err := strconv.ParseUint(string(msg.Id), 10, 64)
+		if err != nil {
+			return ProtocolError("JSON-RPC reply with invalid id " + string(msg.Id))
+		}
+		r.Seq = seq
+		if msg.Error != nil {
+			r.Error = msg.Error.Message
+			if r.Error == "" {
+				r.Error = "Error " + strconv.Itoa(msg.Error.Code)
+			}
+		}
+		return nil
+	}
+	c.lock.Lock()
+	c.seq++
+	r.Type = R_RPC
+	r.Method = msg.Method
+	r.Seq = c.seq
+	c.pending[r.Seq] = &jsonRPCPending{id: msg.Id, notify: msg.Id == nil, batch: msg.batch}
+	c.lock.Unlock()
+	return nil
+}
+
+func (c *jsonRPCCodec) ReadBody(body interface{}) error {
+	msg := c.current
+	target, ok := body.(*[]interface{})
+	if msg == nil || body == nil || !ok {
+		return nil
+	}
+	if msg.Method == "" {
+		return readJSONRPCResult(msg.Result, target)
+	}
+	return readJSONRPCParams(msg.Params, target)
+}
+
+//Decode positional params into the pointers readArguments prepared. Pointer
+//arguments missing at the end are allocated
+func readJSONRPCParams(data json.RawMessage, target *[]interface{}) error {
+	var params []json.RawMessage
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &params); err != nil {
+			return NewError(CodeInvalidArgument, "Invalid params: only positional params are supported")
+		}
+	}
+	ifaces := *target
+	for iPos, param := range params {
+		if iPos >= len(ifaces) {
+			ifaces = append(ifaces, param)
+			continue
+		}
+		if err := json.Unmarshal(param, ifaces[iPos]); err != nil {
+			return NewError(CodeInvalidArgument, "Invalid params: "+err.Error())
+		}
+	}
+	if len(params) < len(ifaces) {
+		missing := ifaces[len(params):]
+		for _, iface := range missing {
+			value := reflect.ValueOf(iface)
+			if value.Kind() != reflect.Ptr || value.Elem().Kind() != reflect.Ptr {
+				//Let readArguments complain about the number of arguments
+				*target = ifaces[:len(params)]
+				return nil
+			}
+		}
+		for _, iface := range missing {
+			value := reflect.ValueOf(iface).Elem()
+			value.Set(reflect.New(value.Type().Elem()))
+		}
+	}
+	*target = ifaces
+	return nil
+}
+
+//Decode the result of a reply into the pointers readReplyBody prepared
+func readJSONRPCResult(data json.RawMessage, target *[]interface{}) error {
+	if len(data) == 0 {
+		return nil
+	}
+	if len(*target) == 1 {
+		return json.Unmarshal(data, (*target)[0])
+	}
+	return json.Unmarshal(data, target)
+}
+
+func (c *jsonRPCCodec) Close() error {
+	return c.rwc.Close()
+}
@@ -0,0 +1,172 @@
+package clacks
+
+import (
+	"encoding/json"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+type jsonRPCPeer struct {
+	t    *testing.T
+	conn net.Conn
+	dec  *json.Decoder
+}
+
+func dialJSONRPC(t *testing.T) *jsonRPCPeer {
+	srv := NewServer()
+	srv.CodecFunc(GenerateJSONRPCCodec)
+	srv.Register(new(DummyService))
+	srv.Register(new(PushService))
+	srv.Register(new(ReverseService))
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen tcp :0: %v", err)
+	}
+	go srv.Accept(l)
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal("dialing", err)
+	}
+	return &jsonRPCPeer{t, conn, json.NewDecoder(conn)}
+}
+
+func (peer *jsonRPCPeer) send(msg string) {
+	if _, err := peer.conn.Write([]byte(msg + "\n")); err != nil {
+		peer.t.Fatal(err)
+	}
+}
+
+func (peer *jsonRPCPeer) recv(val interface{}) {
+	peer.conn.SetReadDeadline(time.Now().Add(time.Second))
+	if err := peer.dec.Decode(val); err != nil {
+		peer.t.Fatal(err)
+	}
+}
+
+type jsonRPCTestResponse struct {
+	Result *Reply
+	Error  *JSONRPCError
+	Id     interface{}
+	Method string
+	Params json.RawMessage
+}
+
+func TestJSONRPC(t *testing.T) {
+	peer := dialJSONRPC(t)
+	defer peer.conn.Close()
+
+	var resp jsonRPCTestResponse
+	peer.send(`{"jsonrpc":"2.0","method":"DummyService.Sum","params":[{"A":1,"B":2}],"id":1}`)
+	peer.recv(&resp)
+	if resp.Error != nil || resp.Result == nil || resp.Result.Num != 3 || resp.Id != float64(1) {
+		t.Error("Unexpected response", resp)
+	}
+
+	for _, test := range []struct {
+		msg  string
+		code int
+	}{
+		{`{"jsonrpc":"2.0","method":"DummyService.Missing","id":"a"}`, JSONRPCMethodNotFound},
+		{`{"jsonrpc":"2.0","method":"DummyService.Sum","params":[],"id":"a"}`, JSONRPCInvalidParams},
+		{`{"jsonrpc":"2.0","method":"DummyService.Sum","params":["x"],"id":"a"}`, JSONRPCInvalidParams},
+		{`{"jsonrpc":"2.0","method":"DummyService.Error","params":[{}],"id":"a"}`, JSONRPCServerError},
+		{`{"jsonrpc":"1.0","method":"DummyService.Sum","id":"a"}`, JSONRPCInvalidRequest},
+	} {
+		resp = jsonRPCTestResponse{}
+		peer.send(test.msg)
+		peer.recv(&resp)
+		if resp.Error == nil || resp.Error.Code != test.code {
+			t.Error("Expected code", test.code, "for", test.msg, "and got", resp.Error)
+		}
+	}
+
+	//Notifications get no response
+	peer.send(`{"jsonrpc":"2.0","method":"DummyService.Sum","params":[{"A":1,"B":2}]}`)
+	var batch []jsonRPCTestResponse
+	peer.send(`[{"jsonrpc":"2.0","method":"DummyService.Sum","params":[{"A":2,"B":2}],"id":2},` +
+		`{"jsonrpc":"2.0","method":"DummyService.Sum","params":[{"A":1,"B":2}]},` +
+		`1,` +
+		`{"jsonrpc":"2.0","method":"DummyService.Sum","params":[{"A":3,"B":3}],"id":3}]`)
+	peer.recv(&batch)
+	if len(batch) != 3 {
+		t.Fatal("Expected 3 responses and got", batch)
+	}
+	results := make(map[interface{}]int)
+	for _, resp := range batch {
+		switch {
+		case resp.Error != nil:
+			results[resp.Id] = resp.Error.Code
+		case resp.Result != nil:
+			results[resp.Id] = resp.Result.Num
+		}
+	}
+	if results[float64(2)] != 4 || results[float64(3)] != 6 || results[nil] != JSONRPCInvalidRequest {
+		t.Error("Unexpected batch responses", results)
+	}
+}
+
+func TestJSONRPCNotifications(t *testing.T) {
+	peer := dialJSONRPC(t)
+	defer peer.conn.Close()
+
+	var push, resp jsonRPCTestResponse
+	peer.send(`{"jsonrpc":"2.0","method":"PushService.PushMe","params":[{"A":4,"B":5}],"id":1}`)
+	peer.recv(&push)
+	peer.recv(&resp)
+	var params struct{ Value PushData }
+	json.Unmarshal(push.Params, &params)
+	if push.Method != "push" || push.Id != nil || params.Value.A != 4 || params.Value.B != 5 {
+		t.Error("Unexpected push notification", push)
+	}
+	if resp.Error != nil || resp.Id != float64(1) {
+		t.Error("Unexpected response", resp)
+	}
+
+	//The server calls ClientService.Mul on the peer
+	var call jsonRPCTestResponse
+	peer.send(`{"jsonrpc":"2.0","method":"ReverseService.Ask","params":[{"A":2,"B":3}],"id":2}`)
+	peer.recv(&call)
+	if call.Method != "ClientService.Mul" || call.Id == nil {
+		t.Fatal("Unexpected call", call)
+	}
+	id, _ := json.Marshal(call.Id)
+	peer.send(`{"jsonrpc":"2.0","result":{"Num":6},"id":` + string(id) + `}`)
+	resp = jsonRPCTestResponse{}
+	peer.recv(&resp)
+	if resp.Error != nil || resp.Result == nil || resp.Result.Num != 6 {
+		t.Error("Unexpected response", resp)
+	}
+
+	//The connection can not be recovered from a parse error
+	resp = jsonRPCTestResponse{}
+	peer.send(`{"jsonrpc":`)
+	peer.send(`}`)
+	peer.recv(&resp)
+	if resp.Error == nil || resp.Error.Code != JSONRPCParseError {
+		t.Error("Expected a parse error and got", resp.Error)
+	}
+}
+
+func TestJSONRPCInvalidReplyId(t *testing.T) {
+	for _, id := range []string{`"0"`, `null`, `-1`} {
+		peer := dialJSONRPC(t)
+		var call jsonRPCTestResponse
+		peer.send(`{"jsonrpc":"2.0","method":"ReverseService.Ask","params":[{"A":2,"B":3}],"id":2}`)
+		peer.recv(&call)
+		if call.Method != "ClientService.Mul" || call.Id == nil {
+			t.Fatal("Unexpected call", call)
+		}
+		//Replies that can not be matched to a call break the protocol
+		peer.send(`{"jsonrpc":"2.0","result":{"Num":6},"id":` + id + `}`)
+		var closing jsonRPCTestResponse
+		peer.recv(&closing)
+		var params struct{ Reason string }
+		json.Unmarshal(closing.Params, &params)
+		if closing.Method != "close" || !strings.HasPrefix(params.Reason, "Protocol error") {
+			t.Error("Expected the server to close the connection for id", id, "and got", closing)
+		}
+		peer.conn.Close()
+	}
+}
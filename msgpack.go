@@ -0,0 +1,803 @@
+package clacks
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"reflect"
+	"strconv"
+	"sync"
+)
+
+// MessagePack format codes
+const (
+	mpNil      = 0xc0
+	mpFalse    = 0xc2
+	mpTrue     = 0xc3
+	mpBin8     = 0xc4
+	mpBin16    = 0xc5
+	mpBin32    = 0xc6
+	mpFloat32  = 0xca
+	mpFloat64  = 0xcb
+	mpUint8    = 0xcc
+	mpUint16   = 0xcd
+	mpUint32   = 0xce
+	mpUint64   = 0xcf
+	mpInt8     = 0xd0
+	mpInt16    = 0xd1
+	mpInt32    = 0xd2
+	mpInt64    = 0xd3
+	mpStr8     = 0xd9
+	mpStr16    = 0xda
+	mpStr32    = 0xdb
+	mpArray16  = 0xdc
+	mpArray32  = 0xdd
+	mpMap16    = 0xde
+	mpMap32    = 0xdf
+	mpFixMap   = 0x80
+	mpFixArray = 0x90
+	mpFixStr   = 0xa0
+	mpNegFix   = 0xe0
+)
+
+type msgpackEncoder struct {
+	w   *bufio.Writer
+	buf [9]byte
+}
+
+//Write a code followed by n bytes of v in big endian
+func (e *msgpackEncoder) writeCode(code byte, v uint64, n int) {
+	e.buf[0] = code
+	for i := n; i > 0; i-- {
+		e.buf[i] = byte(v)
+		v >>= 8
+	}
+	e.w.Write(e.buf[:n+1])
+}
+
+func (e *msgpackEncoder) writeUint(v uint64) {
+	switch {
+	case v < 0x80:
+		e.w.WriteByte(byte(v))
+	case v <= math.MaxUint8:
+		e.writeCode(mpUint8, v, 1)
+	case v <= math.MaxUint16:
+		e.writeCode(mpUint16, v, 2)
+	case v <= math.MaxUint32:
+		e.writeCode(mpUint32, v, 4)
+	default:
+		e.writeCode(mpUint64, v, 8)
+	}
+}
+
+func (e *msgpackEncoder) writeInt(v int64) {
+	switch {
+	case v >= 0:
+		e.writeUint(uint64(v))
+	case v >= -32:
+		e.w.WriteByte(byte(v))
+	case v >= math.MinInt8:
+		e.writeCode(mpInt8, uint64(v), 1)
+	case v >= math.MinInt16:
+		e.writeCode(mpInt16, uint64(v), 2)
+	case v >= math.MinInt32:
+		e.writeCode(mpInt32, uint64(v), 4)
+	default:
+		e.writeCode(mpInt64, uint64(v), 8)
+	}
+}
+
+//Write the header of a string, binary, array or map of n elements
+func (e *msgpackEncoder) writeLen(fixCode byte, fixMax int, codes [3]byte, n int) {
+	switch {
+	case fixMax > 0 && n <= fixMax:
+		e.w.WriteByte(fixCode | byte(n))
+	case codes[0] != 0 && n <= math.MaxUint8:
+		e.writeCode(codes[0], uint64(n), 1)
+	case n <= math.MaxUint16:
+		e.writeCode(codes[1], uint64(n), 2)
+	default:
+		e.writeCode(codes[2], uint64(n), 4)
+	}
+}
+
+func (e *msgpackEncoder) writeString(s string) {
+	e.writeLen(mpFixStr, 31, [3]byte{mpStr8, mpStr16, mpStr32}, len(s))
+	e.w.WriteString(s)
+}
+
+func (e *msgpackEncoder) writeBytes(b []byte) {
+	e.writeLen(0, 0, [3]byte{mpBin8, mpBin16, mpBin32}, len(b))
+	e.w.Write(b)
+}
+
+func (e *msgpackEncoder) writeArrayLen(n int) {
+	e.writeLen(mpFixArray, 15, [3]byte{0, mpArray16, mpArray32}, n)
+}
+
+func (e *msgpackEncoder) writeMapLen(n int) {
+	e.writeLen(mpFixMap, 15, [3]byte{0, mpMap16, mpMap32}, n)
+}
+
+//Get the indexes of the fields that are sent. Only exported ones are
+func exportedFields(typ reflect.Type) []int {
+	fields := make([]int, 0, typ.NumField())
+	for i := 0; i < typ.NumField(); i++ {
+		if typ.Field(i).PkgPath == "" {
+			fields = append(fields, i)
+		}
+	}
+	return fields
+}
+
+// encode writes a value. Structs are sent as maps of their exported fields
+func (e *msgpackEncoder) encode(v reflect.Value) error {
+	if !v.IsValid() {
+		e.w.WriteByte(mpNil)
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			e.w.WriteByte(mpNil)
+			return nil
+		}
+		return e.encode(v.Elem())
+	case reflect.Bool:
+		if v.Bool() {
+			e.w.WriteByte(mpTrue)
+		} else {
+			e.w.WriteByte(mpFalse)
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		e.writeInt(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		e.writeUint(v.Uint())
+	case reflect.Float32:
+		e.writeCode(mpFloat32, uint64(math.Float32bits(float32(v.Float()))), 4)
+	case reflect.Float64:
+		e.writeCode(mpFloat64, math.Float64bits(v.Float()), 8)
+	case reflect.String:
+		e.writeString(v.String())
+	case reflect.Slice, reflect.Array:
+		if v.Kind() == reflect.Slice && v.IsNil() {
+			e.w.WriteByte(mpNil)
+			return nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			bytes := make([]byte, v.Len())
+			reflect.Copy(reflect.ValueOf(bytes), v)
+			e.writeBytes(bytes)
+			return nil
+		}
+		e.writeArrayLen(v.Len())
+		for i := 0; i < v.Len(); i++ {
+			if err := e.encode(v.Index(i)); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		if v.IsNil() {
+			e.w.WriteByte(mpNil)
+			return nil
+		}
+		e.writeMapLen(v.Len())
+		for _, key := range v.MapKeys() {
+			if err := e.encode(key); err != nil {
+				return err
+			}
+			if err := e.encode(v.MapIndex(key)); err != nil {
+				return err
+			}
+		}
+	case reflect.Struct:
+		fields := exportedFields(v.Type())
+		e.writeMapLen(len(fields))
+		for _, iField := range fields {
+			e.writeString(v.Type().Field(iField).Name)
+			if err := e.encode(v.Field(iField)); err != nil {
+				return err
+			}
+		}
+	default:
+		return errors.New("msgpack: cannot encode " + v.Type().String())
+	}
+	return nil
+}
+
+// msgpackPrealloc is the most elements or bytes allocated for a value before
+// reading them. Lengths come from the peer so bigger values grow as they are
+// read.
+const msgpackPrealloc = 1 << 10
+
+// msgpackMaxDepth is the deepest nesting of values accepted, like the one of
+// encoding/json. Values are decoded recursively so deeper ones would
+// overflow the stack.
+const msgpackMaxDepth = 10000
+
+type msgpackDecoder struct {
+	r      *bufio.Reader
+	maxLen int // longest string, binary, array or map accepted. 0 is DefaultMaxBodySize
+	depth  int // values being decoded
+}
+
+//Count a value that is being decoded. Call leave once it is done
+func (d *msgpackDecoder) enter() error {
+	d.depth++
+	if d.depth > msgpackMaxDepth {
+		return ProtocolError("msgpack: values nested deeper than " + strconv.Itoa(msgpackMaxDepth))
+	}
+	return nil
+}
+
+func (d *msgpackDecoder) leave() {
+	d.depth--
+}
+
+//Check a length read from the peer. Each element takes at least a byte so
+//no value longer than the biggest message accepted can be valid
+func (d *msgpackDecoder) checkLen(n uint64) (int, error) {
+	maxLen := d.maxLen
+	if maxLen <= 0 {
+		maxLen = DefaultMaxBodySize
+	}
+	if n > uint64(maxLen) {
+		return 0, ProtocolError("msgpack: length " + strconv.FormatUint(n, 10) + " exceeds the limit of " + strconv.Itoa(maxLen))
+	}
+	return int(n), nil
+}
+
+//Allocation for a value of n elements
+func preallocLen(n int) int {
+	if n > msgpackPrealloc {
+		return msgpackPrealloc
+	}
+	return n
+}
+
+//Read n bytes as a big endian number
+func (d *msgpackDecoder) readUint(n int) (uint64, error) {
+	var buf [8]byte
+	if _, err := io.ReadFull(d.r, buf[8-n:]); err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(buf[:]), nil
+}
+
+//Read n bytes. Long ones are read in chunks so that only what arrives is
+//allocated
+func (d *msgpackDecoder) readBytes(n int) ([]byte, error) {
+	if n <= msgpackPrealloc {
+		data := make([]byte, n)
+		_, err := io.ReadFull(d.r, data)
+		return data, err
+	}
+	var buf bytes.Buffer
+	_, err := io.CopyN(&buf, d.r, int64(n))
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return buf.Bytes(), err
+}
+
+//Read the length of an array or map whose code has been read. Returns
+//false if the code is not for that kind of value
+func (d *msgpackDecoder) readLen(code byte, fixCode byte, code16 byte) (int, bool, error) {
+	switch {
+	case code&0xf0 == fixCode:
+		return int(code & 0x0f), true, nil
+	case code == code16, code == code16+1:
+		n, err := d.readUint(2 << (code - code16))
+		if err != nil {
+			return 0, true, err
+		}
+		length, err := d.checkLen(n)
+		return length, true, err
+	}
+	return 0, false, nil
+}
+
+func (d *msgpackDecoder) readArrayLen(code byte) (int, error) {
+	n, ok, err := d.readLen(code, mpFixArray, mpArray16)
+	if !ok {
+		return 0, errors.New("msgpack: expected an array")
+	}
+	return n, err
+}
+
+func (d *msgpackDecoder) readMapLen(code byte) (int, error) {
+	n, ok, err := d.readLen(code, mpFixMap, mpMap16)
+	if !ok {
+		return 0, errors.New("msgpack: expected a map")
+	}
+	return n, err
+}
+
+//Read the rest of a value whose code has been read into a generic value.
+//Integers are int64 unless they only fit in an uint64. Maps with string
+//keys are map[string]interface{}
+func (d *msgpackDecoder) decodeCode(code byte) (interface{}, error) {
+	switch {
+	case code < 0x80:
+		return int64(code), nil
+	case code >= mpNegFix:
+		return int64(int8(code)), nil
+	case code&0xe0 == mpFixStr, code >= mpStr8 && code <= mpStr32, code >= mpBin8 && code <= mpBin32:
+		var n uint64
+		var err error
+		switch {
+		case code&0xe0 == mpFixStr:
+			n = uint64(code & 0x1f)
+		case code >= mpStr8:
+			n, err = d.readUint(1 << (code - mpStr8))
+		default:
+			n, err = d.readUint(1 << (code - mpBin8))
+		}
+		if err != nil {
+			return nil, err
+		}
+		length, err := d.checkLen(n)
+		if err != nil {
+			return nil, err
+		}
+		data, err := d.readBytes(length)
+		if code >= mpBin8 && code <= mpBin32 {
+			return data, err
+		}
+		return string(data), err
+	case code&0xf0 == mpFixArray, code == mpArray16, code == mpArray32:
+		n, err := d.readArrayLen(code)
+		if err != nil {
+			return nil, err
+		}
+		values := make([]interface{}, 0, preallocLen(n))
+		for i := 0; i < n; i++ {
+			value, err := d.decodeInterface()
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, value)
+		}
+		return values, nil
+	case code&0xf0 == mpFixMap, code == mpMap16, code == mpMap32:
+		n, err := d.readMapLen(code)
+		if err != nil {
+			return nil, err
+		}
+		values := make(map[interface{}]interface{}, preallocLen(n))
+		strKeys := true
+		for i := 0; i < n; i++ {
+			key, err := d.decodeInterface()
+			if err != nil {
+				return nil, err
+			}
+			if values[key], err = d.decodeInterface(); err != nil {
+				return nil, err
+			}
+			_, isStr := key.(string)
+			strKeys = strKeys && isStr
+		}
+		if !strKeys {
+			return values, nil
+		}
+		strValues := make(map[string]interface{}, len(values))
+		for key, value := range values {
+			strValues[key.(string)] = value
+		}
+		return strValues, nil
+	}
+	switch code {
+	case mpNil:
+		return nil, nil
+	case mpFalse:
+		return false, nil
+	case mpTrue:
+		return true, nil
+	case mpFloat32:
+		bits, err := d.readUint(4)
+		return math.Float32frombits(uint32(bits)), err
+	case mpFloat64:
+		bits, err := d.readUint(8)
+		return math.Float64frombits(bits), err
+	case mpUint8, mpUint16, mpUint32, mpUint64:
+		n, err := d.readUint(1 << (code - mpUint8))
+		if n > math.MaxInt64 {
+			return n, err
+		}
+		return int64(n), err
+	case mpInt8, mpInt16, mpInt32, mpInt64:
+		size := 1 << (code - mpInt8)
+		n, err := d.readUint(size)
+		//Sign extension
+		shift := uint(64 - 8*size)
+		return int64(n<<shift) >> shift, err
+	}
+	return nil, errors.New("msgpack: unsupported format code 0x" + strconv.FormatUint(uint64(code), 16))
+}
+
+func (d *msgpackDecoder) decodeInterface() (interface{}, error) {
+	defer d.leave()
+	if err := d.enter(); err != nil {
+		return nil, err
+	}
+	code, err := d.r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	return d.decodeCode(code)
+}
+
+//Set a generic scalar value into v converting it if needed
+func setScalar(v reflect.Value, val interface{}) error {
+	rval := reflect.ValueOf(val)
+	switch v.Kind() {
+	case reflect.Bool:
+		if b, ok := val.(bool); ok {
+			v.SetBool(b)
+			return nil
+		}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		switch n := val.(type) {
+		case int64:
+			v.SetInt(n)
+			return nil
+		case uint64:
+			v.SetInt(int64(n))
+			return nil
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		switch n := val.(type) {
+		case int64:
+			v.SetUint(uint64(n))
+			return nil
+		case uint64:
+			v.SetUint(n)
+			return nil
+		}
+	case reflect.Float32, reflect.Float64:
+		switch n := val.(type) {
+		case int64:
+			v.SetFloat(float64(n))
+			return nil
+		case uint64:
+			v.SetFloat(float64(n))
+			return nil
+		case float32:
+			v.SetFloat(float64(n))
+			return nil
+		case float64:
+			v.SetFloat(n)
+			return nil
+		}
+	case reflect.String:
+		switch s := val.(type) {
+		case string:
+			v.SetString(s)
+			return nil
+		case []byte:
+			v.SetString(string(s))
+			return nil
+		}
+	case reflect.Slice:
+		if v.Type().Elem().Kind() != reflect.Uint8 {
+			break
+		}
+		switch s := val.(type) {
+		case string:
+			v.SetBytes([]byte(s))
+			return nil
+		case []byte:
+			v.SetBytes(s)
+			return nil
+		}
+	}
+	return errors.New("msgpack: cannot decode " + rval.Type().String() + " into " + v.Type().String())
+}
+
+// decode reads a value into v. Interfaces holding a pointer are decoded into
+// what it points to so that callers can choose the type of the values.
+func (d *msgpackDecoder) decode(v reflect.Value) error {
+	defer d.leave()
+	if err := d.enter(); err != nil {
+		return err
+	}
+	code, err := d.r.ReadByte()
+	if err != nil {
+		return err
+	}
+	if code == mpNil {
+		switch v.Kind() {
+		case reflect.Ptr, reflect.Interface, reflect.Slice, reflect.Map:
+			v.Set(reflect.Zero(v.Type()))
+		}
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		d.r.UnreadByte()
+		return d.decode(v.Elem())
+	case reflect.Interface:
+		if !v.IsNil() && v.Elem().Kind() == reflect.Ptr && !v.Elem().IsNil() {
+			d.r.UnreadByte()
+			return d.decode(v.Elem().Elem())
+		}
+		if v.NumMethod() > 0 {
+			return errors.New("msgpack: cannot decode into " + v.Type().String())
+		}
+		val, err := d.decodeCode(code)
+		if err != nil {
+			return err
+		}
+		if val == nil {
+			v.Set(reflect.Zero(v.Type()))
+		} else {
+			v.Set(reflect.ValueOf(val))
+		}
+		return nil
+	case reflect.Slice, reflect.Array:
+		if v.Type().Elem().Kind() == reflect.Uint8 && (code < mpFixArray || code >= mpFixStr) && code != mpArray16 && code != mpArray32 {
+			break
+		}
+		n, err := d.readArrayLen(code)
+		if err != nil {
+			return err
+		}
+		if v.Kind() == reflect.Slice && n < v.Len() {
+			v.SetLen(n)
+		}
+		for i := 0; i < n; i++ {
+			//Existing elements are kept so that they are decoded into. New
+			//ones are added as they are read
+			if v.Kind() == reflect.Slice && i >= v.Len() {
+				v.Set(reflect.Append(v, reflect.Zero(v.Type().Elem())))
+			}
+			if i >= v.Len() {
+				if _, err := d.decodeInterface(); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := d.decode(v.Index(i)); err != nil {
+				return err
+			}
+		}
+		return nil
+	case reflect.Map:
+		n, err := d.readMapLen(code)
+		if err != nil {
+			return err
+		}
+		if v.IsNil() {
+			v.Set(reflect.MakeMapWithSize(v.Type(), preallocLen(n)))
+		}
+		for i := 0; i < n; i++ {
+			key := reflect.New(v.Type().Key()).Elem()
+			if err := d.decode(key); err != nil {
+				return err
+			}
+			value := reflect.New(v.Type().Elem()).Elem()
+			if err := d.decode(value); err != nil {
+				return err
+			}
+			v.SetMapIndex(key, value)
+		}
+		return nil
+	case reflect.Struct:
+		n, err := d.readMapLen(code)
+		if err != nil {
+			return err
+		}
+		for i := 0; i < n; i++ {
+			var name string
+			if err := d.decode(reflect.ValueOf(&name).Elem()); err != nil {
+				return err
+			}
+			field, ok := v.Type().FieldByName(name)
+			if !ok || field.PkgPath != "" || len(field.Index) > 1 {
+				if _, err := d.decodeInterface(); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := d.decode(v.Field(field.Index[0])); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	val, err := d.decodeCode(code)
+	if err != nil {
+		return err
+	}
+	if v.Kind() == reflect.Array {
+		data, ok := val.([]byte)
+		if !ok {
+			return errors.New("msgpack: cannot decode into " + v.Type().String())
+		}
+		reflect.Copy(v, reflect.ValueOf(data))
+		return nil
+	}
+	return setScalar(v, val)
+}
+
+// msgpackCodec sends headers as arrays and bodies as MessagePack values.
+// Request headers are [Type, Method, Seq, Error, Metadata], where Metadata
+// is a map of strings or nil, and response headers [Type, Seq, Error, Topic,
+// Method, PushSeq, Code, Retryable, Causes, HasDetail]. Causes is an array
+// of maps with the Code and Message of each error wrapped by the error of
+// the response, outermost first. The body of an error response holds its
+// detail if HasDetail is true. Values sent as an interface, like pushes, are
+// sent as a map with their type name and value.
+type msgpackCodec struct {
+	rwc       io.ReadWriteCloser
+	types     *TypeTable
+	enc       *msgpackEncoder
+	dec       *msgpackDecoder
+	writeLock sync.Mutex
+}
+
+// GenerateMsgpackCodec creates a codec that speaks MessagePack over the
+// connection. It can be set with Server.CodecFunc and used with
+// NewClientWithCodec.
+func GenerateMsgpackCodec(conn io.ReadWriteCloser) Codec {
+	dec := &msgpackDecoder{r: bufio.NewReader(conn)}
+	//Nothing longer than the biggest frame can arrive
+	if fc, ok := conn.(*frameConn); ok {
+		for _, limit := range fc.limits {
+			if limit > dec.maxLen {
+				dec.maxLen = limit
+			}
+		}
+	}
+	return &msgpackCodec{
+		rwc:   conn,
+		types: NewTypeTable(),
+		enc:   &msgpackEncoder{w: bufio.NewWriter(conn)},
+		dec:   dec,
+	}
+}
+
+func (c *msgpackCodec) SetTypeTable(types *TypeTable) {
+	c.types = types
+}
+
+func (c *msgpackCodec) encodeBody(body interface{}) error {
+	iface, ok := body.(*interface{})
+	if !ok {
+		return c.enc.encode(reflect.ValueOf(body))
+	}
+	value := reflect.ValueOf(*iface)
+	if !value.IsValid() {
+		return c.enc.encode(value)
+	}
+	//The type goes first so that the value can be decoded as it is read
+	c.enc.writeMapLen(2)
+	c.enc.writeString("type")
+	c.enc.writeString(c.types.nameOf(value.Type()))
+	c.enc.writeString("value")
+	return c.enc.encode(value)
+}
+
+func (c *msgpackCodec) write(header []interface{}, body interface{}) error {
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	if err := c.enc.encode(reflect.ValueOf(header)); err != nil {
+		return err
+	}
+	if err := flushFrame(c.enc.w, c.rwc, FrameHeader); err != nil {
+		return err
+	}
+	if body != nil {
+		if err := c.encodeBody(body); err != nil {
+			return err
+		}
+		if err := flushFrame(c.enc.w, c.rwc, FrameBody); err != nil {
+			return err
+		}
+	}
+	return c.enc.w.Flush()
+}
+
+func (c *msgpackCodec) WriteRequest(r *Request, body interface{}) error {
+	return c.write([]interface{}{r.Type, r.Method, r.Seq, r.Error, r.Metadata}, body)
+}
+
+func (c *msgpackCodec) WriteResponse(r *Response, body interface{}) error {
+	return c.write([]interface{}{r.Type, r.Seq, r.Error, r.Topic, r.Method, r.PushSeq, r.Code, r.Retryable, r.Causes, r.HasDetail}, body)
+}
+
+//Close the frame of a header or body once it is read. Errors that leave the
+//frame read do not break the connection
+func (c *msgpackCodec) endRead(err error) error {
+	if endErr := EndRead(c.rwc, c.dec.r.Buffered()); err == nil {
+		err = endErr
+	}
+	return err
+}
+
+func (c *msgpackCodec) ReadRequestHeader(r *Request) error {
+	fields := []interface{}{&r.Type, &r.Method, &r.Seq, &r.Error, &r.Metadata}
+	return c.endRead(c.dec.decode(reflect.ValueOf(&fields).Elem()))
+}
+
+func (c *msgpackCodec) ReadResponseHeader(r *Response) error {
+	fields := []interface{}{&r.Type, &r.Seq, &r.Error, &r.Topic, &r.Method, &r.PushSeq, &r.Code, &r.Retryable, &r.Causes, &r.HasDetail}
+	return c.endRead(c.dec.decode(reflect.ValueOf(&fields).Elem()))
+}
+
+// ReadBody decodes the next body into body. Like with JSON, slices of
+// interfaces have to be filled with pointers to the expected types.
+func (c *msgpackCodec) ReadBody(body interface{}) error {
+	return c.endRead(c.readBody(body))
+}
+
+func (c *msgpackCodec) readBody(body interface{}) error {
+	switch target := body.(type) {
+	case nil:
+		_, err := c.dec.decodeInterface()
+		return err
+	case *interface{}:
+		if *target != nil {
+			break
+		}
+		return c.readTyped(target)
+	}
+	value := reflect.ValueOf(body)
+	if value.Kind() != reflect.Ptr || value.IsNil() {
+		return errors.New("msgpack: body must be a non nil pointer")
+	}
+	return c.dec.decode(value.Elem())
+}
+
+//Read a value sent with its type name
+func (c *msgpackCodec) readTyped(target *interface{}) error {
+	code, err := c.dec.r.ReadByte()
+	if err != nil || code == mpNil {
+		return err
+	}
+	n, err := c.dec.readMapLen(code)
+	if err != nil {
+		return err
+	}
+	typeName := ""
+	for i := 0; i < n; i++ {
+		var key string
+		if err := c.dec.decode(reflect.ValueOf(&key).Elem()); err != nil {
+			return err
+		}
+		switch key {
+		case "type":
+			if err := c.dec.decode(reflect.ValueOf(&typeName).Elem()); err != nil {
+				return err
+			}
+		case "value":
+			typ, ok := c.types.lookup(typeName)
+			if !ok {
+				if *target, err = c.dec.decodeInterface(); err != nil {
+					return err
+				}
+				continue
+			}
+			value := reflect.New(typ)
+			if err := c.dec.decode(value.Elem()); err != nil {
+				return err
+			}
+			*target = value.Interface()
+		default:
+			if _, err := c.dec.decodeInterface(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (c *msgpackCodec) Close() error {
+	return c.rwc.Close()
+}
@@ -0,0 +1,189 @@
+package clacks
+
+import (
+	"bufio"
+	"bytes"
+	"math"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type MsgpackData struct {
+	I     int
+	U     uint16
+	F     float64
+	S     string
+	B     []byte
+	L     []string
+	M     map[string]int
+	P     *BodyData
+	N     *BodyData
+	Any   interface{}
+	local int
+}
+
+func TestMsgpackValues(t *testing.T) {
+	values := []interface{}{
+		true, false, 0, 127, 128, 300, 70000, int64(math.MaxInt64), -1, -32, -33, -200, -40000, int64(math.MinInt64),
+		uint64(math.MaxUint64), float32(1.5), 2.25, "", "short", string(make([]byte, 40)), string(make([]byte, 300)),
+		[]byte{1, 2, 3}, []int{1, -2, 3}, make([]int, 20), map[string]bool{"a": true},
+		MsgpackData{1, 2, 3.5, "s", []byte("b"), []string{"x", "y"}, map[string]int{"k": 9}, &BodyData{4, "p"}, nil, "any", 0},
+	}
+	for _, value := range values {
+		var buf bytes.Buffer
+		enc := &msgpackEncoder{w: bufio.NewWriter(&buf)}
+		if err := enc.encode(reflect.ValueOf(value)); err != nil {
+			t.Fatal(err)
+		}
+		enc.w.Flush()
+		dec := &msgpackDecoder{r: bufio.NewReader(&buf)}
+		decoded := reflect.New(reflect.TypeOf(value))
+		if err := dec.decode(decoded.Elem()); err != nil {
+			t.Fatal("decoding", value, err)
+		}
+		if !reflect.DeepEqual(value, decoded.Elem().Interface()) {
+			t.Errorf("Expected %#v and got %#v", value, decoded.Elem().Interface())
+		}
+	}
+}
+
+func TestMsgpackHostileLength(t *testing.T) {
+	for _, data := range [][]byte{
+		{0xdd, 0x7f, 0xff, 0xff, 0xff}, //array of 2^31-1 elements
+		{0xdf, 0xff, 0xff, 0xff, 0xff}, //map of 2^32-1 entries
+		{0xc6, 0x7f, 0xff, 0xff, 0xff}, //binary of 2^31-1 bytes
+		{0xdb, 0x00, 0x10, 0x00, 0x00}, //string of 1MiB, within the limit but not there
+	} {
+		dec := &msgpackDecoder{r: bufio.NewReader(bytes.NewReader(data))}
+		if _, err := dec.decodeInterface(); err == nil {
+			t.Errorf("Expected an error decoding % x", data)
+		}
+		var values []int
+		dec = &msgpackDecoder{r: bufio.NewReader(bytes.NewReader(data))}
+		if err := dec.decode(reflect.ValueOf(&values).Elem()); err == nil {
+			t.Errorf("Expected an error decoding % x into a slice", data)
+		}
+	}
+	dec := &msgpackDecoder{r: bufio.NewReader(bytes.NewReader([]byte{0xdc, 0x01, 0x00})), maxLen: 16}
+	if _, err := dec.decodeInterface(); err == nil || !strings.Contains(err.Error(), "exceeds the limit") {
+		t.Error("Expected the length to exceed the limit and got", err)
+	}
+}
+
+func TestMsgpackDeepNesting(t *testing.T) {
+	//Arrays of one array down to a nil
+	data := append(bytes.Repeat([]byte{0x91}, 1<<20), mpNil)
+	dec := &msgpackDecoder{r: bufio.NewReader(bytes.NewReader(data))}
+	if _, err := dec.decodeInterface(); err == nil || !strings.Contains(err.Error(), "nested deeper") {
+		t.Error("Expected the nesting to be refused and got", err)
+	}
+	var values []interface{}
+	dec = &msgpackDecoder{r: bufio.NewReader(bytes.NewReader(data))}
+	if err := dec.decode(reflect.ValueOf(&values).Elem()); err == nil || !strings.Contains(err.Error(), "nested deeper") {
+		t.Error("Expected the nesting to be refused decoding into a slice and got", err)
+	}
+	//Nesting within the limit is fine
+	data = append(bytes.Repeat([]byte{0x91}, 100), mpNil)
+	dec = &msgpackDecoder{r: bufio.NewReader(bytes.NewReader(data))}
+	if _, err := dec.decodeInterface(); err != nil || dec.depth != 0 {
+		t.Error("Unexpected error decoding nested arrays", err, dec.depth)
+	}
+}
+
+func TestMsgpackCodec(t *testing.T) {
+	buf := RWCMock{}
+	codec := GenerateMsgpackCodec(&buf)
+	types := NewTypeTable()
+	types.Register(BodyData{})
+	codec.SetTypeTable(types)
+	req := Request{Type: R_RPC, Method: "A.B", Seq: 3, Metadata: map[string]string{"trace": "abc"}}
+	resp := Response{Type: R_PUSH, Seq: 9, Topic: "news", PushSeq: 2}
+	data := BodyData{234234, "LOL"}
+	var pushed interface{} = data
+
+	if err := codec.WriteRequest(&req, []interface{}{data, 5}); err != nil {
+		t.Error(err)
+	}
+	if err := codec.WriteResponse(&resp, &pushed); err != nil {
+		t.Error(err)
+	}
+	if buf.data.Bytes()[0] != 0x95 {
+		t.Error("Request header is not an array of 5 elements")
+	}
+
+	readReq := new(Request)
+	if err := codec.ReadRequestHeader(readReq); err != nil {
+		t.Error(err)
+	}
+	ifaces := []interface{}{new(BodyData), new(int)}
+	if err := codec.ReadBody(&ifaces); err != nil {
+		t.Error(err)
+	}
+	if !reflect.DeepEqual(req, *readReq) {
+		t.Error("Requests are not the same")
+	}
+	if len(ifaces) != 2 || !reflect.DeepEqual(data, *ifaces[0].(*BodyData)) || *ifaces[1].(*int) != 5 {
+		t.Error("Request bodies are not the same", ifaces)
+	}
+
+	readResp := new(Response)
+	if err := codec.ReadResponseHeader(readResp); err != nil {
+		t.Error(err)
+	}
+	var readPush interface{}
+	if err := codec.ReadBody(&readPush); err != nil {
+		t.Error(err)
+	}
+	if !reflect.DeepEqual(resp, *readResp) {
+		t.Error("Response are not the same")
+	}
+	if body, ok := readPush.(*BodyData); !ok || !reflect.DeepEqual(data, *body) {
+		t.Error("Pushed values are not the same", readPush)
+	}
+}
+
+func TestMsgpackClient(t *testing.T) {
+	srv := NewServer()
+	srv.CodecFunc(GenerateMsgpackCodec)
+	srv.Register(new(DummyService))
+	srv.Register(new(PushService))
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen tcp :0: %v", err)
+	}
+	go srv.Accept(l)
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal("dialing", err)
+	}
+	client := NewClientWithCodec(GenerateMsgpackCodec(conn))
+	defer client.Close()
+	reply := new(Reply)
+	if err := client.Call("DummyService.Sum", Args{3, 4}, reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.Num != 7 {
+		t.Error("Expected 7 and got", reply.Num)
+	}
+	if err := client.Call("DummyService.Error", Args{}, reply); err == nil || err.Error() != "Test Error" {
+		t.Error("Unexpected error", err)
+	}
+	received := make(chan PushData, 1)
+	if err := client.SubscribeToPush(func(pd PushData) { received <- pd }); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Call("PushService.PushMe", Args{5, 6}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case pd := <-received:
+		if pd.A != 5 || pd.B != 6 {
+			t.Error("Pushed data differs", pd)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Push was not received")
+	}
+}
@@ -0,0 +1,108 @@
+package clacks
+
+import (
+	"errors"
+	"sync"
+)
+
+const pubSubServiceName = "PubSub"
+
+// topicMap keeps track of which connections are subscribed to each topic
+type topicMap struct {
+	lock   sync.RWMutex
+	topics map[string]map[uint64]*connection
+}
+
+func (tm *topicMap) subscribe(topic string, conn *connection) {
+	tm.lock.Lock()
+	defer tm.lock.Unlock()
+	if tm.topics == nil {
+		tm.topics = make(map[string]map[uint64]*connection)
+	}
+	subs, ok := tm.topics[topic]
+	if !ok {
+		subs = make(map[uint64]*connection)
+		tm.topics[topic] = subs
+	}
+	subs[conn.id] = conn
+}
+
+func (tm *topicMap) unsubscribe(topic string, connId uint64) {
+	tm.lock.Lock()
+	defer tm.lock.Unlock()
+	if subs, ok := tm.topics[topic]; ok {
+		delete(subs, connId)
+		if len(subs) == 0 {
+			delete(tm.topics, topic)
+		}
+	}
+}
+
+//Remove a connection from all the topics it is subscribed to and return them
+func (tm *topicMap) unsubscribeAll(connId uint64) []string {
+	tm.lock.Lock()
+	defer tm.lock.Unlock()
+	topics := make([]string, 0)
+	for topic, subs := range tm.topics {
+		if _, present := subs[connId]; !present {
+			continue
+		}
+		topics = append(topics, topic)
+		delete(subs, connId)
+		if len(subs) == 0 {
+			delete(tm.topics, topic)
+		}
+	}
+	return topics
+}
+
+func (tm *topicMap) subscribers(topic string) []*connection {
+	tm.lock.RLock()
+	defer tm.lock.RUnlock()
+	subs := tm.topics[topic]
+	conns := make([]*connection, 0, len(subs))
+	for _, conn := range subs {
+		conns = append(conns, conn)
+	}
+	return conns
+}
+
+// PubSub is the built-in service that clients use to manage their topic
+// subscriptions. It is registered in every server under the name PubSub.
+type PubSub struct {
+	server *Server
+}
+
+//Subscribe the calling client to a topic
+func (ps *PubSub) Subscribe(ctx *Context, topic string) error {
+	conn := ctx.getConnection()
+	if conn == nil {
+		return errors.New("Context is not bound to a connection")
+	}
+	ps.server.topics.subscribe(topic, conn)
+	return nil
+}
+
+//Unsubscribe the calling client from a topic
+func (ps *PubSub) Unsubscribe(ctx *Context, topic string) error {
+	ps.server.topics.unsubscribe(topic, ctx.GetClientId())
+	return nil
+}
+
+// Publish sends a value as a push to every client subscribed to the topic.
+// It returns the number of clients the value was sent to and the last error
+// found while sending it. Clients away with a resumable session get the
+// value buffered and are not counted.
+func (server *Server) Publish(topic string, value interface{}) (int, error) {
+	var err error
+	sent := 0
+	server.sessions.bufferTopic(topic, value)
+	for _, conn := range server.topics.subscribers(topic) {
+		if pErr := conn.push(topic, value); pErr != nil {
+			err = pErr
+			continue
+		}
+		sent++
+	}
+	return sent, err
+}
@@ -0,0 +1,206 @@
+package clacks
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// QueuePolicy decides what happens when the outbound queue of a connection
+// is full
+type QueuePolicy int
+
+const (
+	QueueBlock          QueuePolicy = iota //Wait until there is room
+	QueueDropOldestPush                    //Drop the oldest queued push to make room
+	QueueDropNewestPush                    //Drop the push being sent
+	QueueDisconnect                        //Close the connection
+)
+
+const (
+	defaultQueueSize  = 256
+	queueDrainTimeout = time.Second
+)
+
+var (
+	ErrPushDropped = errors.New("push dropped because the outbound queue is full")
+	ErrQueueFull   = errors.New("outbound queue is full")
+)
+
+type outMessage struct {
+	resp Response
+	body interface{}
+}
+
+// queuedCodec sends the responses of a codec from a dedicated goroutine so
+// that a slow reader does not stall the goroutines that write to it. Drop
+// policies only apply to R_PUSH responses. The rest are never dropped.
+type queuedCodec struct {
+	Codec
+	size     int
+	policy   QueuePolicy
+	lock     sync.Mutex // protects following
+	notEmpty *sync.Cond
+	notFull  *sync.Cond
+	queue    []*outMessage
+	closed   bool
+	err      error
+	dropped  uint64
+	done     chan struct{}
+}
+
+func newQueuedCodec(codec Codec, size int, policy QueuePolicy) *queuedCodec {
+	q := &queuedCodec{Codec: codec, size: size, policy: policy, done: make(chan struct{})}
+	q.notEmpty = sync.NewCond(&q.lock)
+	q.notFull = sync.NewCond(&q.lock)
+	go q.writer()
+	return q
+}
+
+//Queue a response to be written by the writer goroutine
+func (q *queuedCodec) WriteResponse(r *Response, body interface{}) error {
+	msg := &outMessage{resp: *r, body: body}
+	msg.resp.next = nil
+	isPush := r.Type == R_PUSH
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	for {
+		switch {
+		case q.err != nil:
+			return q.err
+		case q.closed:
+			return ErrShutdown
+		case len(q.queue) < q.size:
+			q.queue = append(q.queue, msg)
+			q.notEmpty.Signal()
+			return nil
+		}
+		switch q.policy {
+		case QueueDisconnect:
+			q.fail(ErrQueueFull)
+			return ErrQueueFull
+		case QueueDropNewestPush:
+			if isPush {
+				q.dropped++
+				return ErrPushDropped
+			}
+		case QueueDropOldestPush:
+			if q.dropOldestPush() {
+				continue
+			}
+		}
+		q.notFull.Wait()
+	}
+}
+
+//Queue the R_CLOSE of a disconnection without waiting for room. A client
+//that lets the queue fill is not reading, so the queue is dropped and the
+//connection closed instead
+func (q *queuedCodec) writeClose(r *Response) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	switch {
+	case q.err != nil:
+		return q.err
+	case q.closed:
+		return ErrShutdown
+	case len(q.queue) >= q.size:
+		q.fail(ErrQueueFull)
+		return ErrQueueFull
+	}
+	msg := &outMessage{resp: *r}
+	msg.resp.next = nil
+	q.queue = append(q.queue, msg)
+	q.notEmpty.Signal()
+	return nil
+}
+
+//Remove the oldest queued push. Returns false if there is none
+func (q *queuedCodec) dropOldestPush() bool {
+	for iPos, msg := range q.queue {
+		if msg.resp.Type == R_PUSH {
+			copy(q.queue[iPos:], q.queue[iPos+1:])
+			q.queue[len(q.queue)-1] = nil
+			q.queue = q.queue[:len(q.queue)-1]
+			q.dropped++
+			return true
+		}
+	}
+	return false
+}
+
+//Stop sending and close the connection. Must be called with the lock held
+func (q *queuedCodec) fail(err error) {
+	if q.err == nil {
+		q.err = err
+		q.queue = nil
+		go q.Codec.Close()
+	}
+	q.notEmpty.Broadcast()
+	q.notFull.Broadcast()
+}
+
+func (q *queuedCodec) writer() {
+	defer close(q.done)
+	for {
+		q.lock.Lock()
+		for len(q.queue) == 0 && !q.closed && q.err == nil {
+			q.notEmpty.Wait()
+		}
+		if q.err != nil || len(q.queue) == 0 {
+			q.lock.Unlock()
+			return
+		}
+		msg := q.queue[0]
+		q.queue[0] = nil
+		q.queue = q.queue[1:]
+		q.notFull.Signal()
+		q.lock.Unlock()
+		if err := q.Codec.WriteResponse(&msg.resp, msg.body); err != nil {
+			q.lock.Lock()
+			q.fail(err)
+			q.lock.Unlock()
+			return
+		}
+	}
+}
+
+//Get the number of queued responses and the number of dropped pushes
+func (q *queuedCodec) stats() (int, uint64) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return len(q.queue), q.dropped
+}
+
+//Send what is queued and close the codec. Gives up sending after a while
+func (q *queuedCodec) Close() error {
+	q.lock.Lock()
+	if q.closed {
+		q.lock.Unlock()
+		return ErrShutdown
+	}
+	q.closed = true
+	q.notEmpty.Broadcast()
+	q.notFull.Broadcast()
+	//fail already closed the codec
+	if err := q.err; err != nil {
+		q.lock.Unlock()
+		return err
+	}
+	q.lock.Unlock()
+	select {
+	case <-q.done:
+	case <-time.After(queueDrainTimeout):
+	}
+	return q.Codec.Close()
+}
+
+// SetOutboundQueue sets the size of the queue of responses and pushes of
+// each connection and what to do when it is full. A size of 0 writes
+// directly to the connection. Applies to connections made afterwards.
+func (server *Server) SetOutboundQueue(size int, policy QueuePolicy) {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	server.queueSize = size
+	server.queuePolicy = policy
+}
@@ -0,0 +1,157 @@
+package clacks
+
+import (
+	"testing"
+	"time"
+)
+
+// blockingCodec records the responses written once it is released
+type blockingCodec struct {
+	gobCodec
+	release chan struct{}
+	written chan Response
+	closed  chan struct{}
+}
+
+func newBlockingCodec() *blockingCodec {
+	return &blockingCodec{release: make(chan struct{}), written: make(chan Response, 100), closed: make(chan struct{})}
+}
+
+func (bc *blockingCodec) WriteResponse(r *Response, body interface{}) error {
+	<-bc.release
+	bc.written <- *r
+	return nil
+}
+
+func (bc *blockingCodec) Close() error {
+	close(bc.closed)
+	return nil
+}
+
+//Fill a queue of size 2. The writer goroutine holds one more response
+func fillQueue(t *testing.T, q *queuedCodec) {
+	for i := 0; i < 3; i++ {
+		if err := q.WriteResponse(&Response{Type: R_PUSH, Topic: string(rune('a' + i))}, nil); err != nil {
+			t.Fatal(err)
+		}
+		for iw := 0; i == 0 && iw < 100; iw++ {
+			if queued, _ := q.stats(); queued == 0 {
+				break
+			}
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
+
+func TestQueueDropNewest(t *testing.T) {
+	bc := newBlockingCodec()
+	q := newQueuedCodec(bc, 2, QueueDropNewestPush)
+	fillQueue(t, q)
+	if err := q.WriteResponse(&Response{Type: R_PUSH, Topic: "d"}, nil); err != ErrPushDropped {
+		t.Fatal("Expected the push to be dropped and got", err)
+	}
+	if queued, dropped := q.stats(); queued != 2 || dropped != 1 {
+		t.Fatal("Unexpected stats", queued, dropped)
+	}
+	close(bc.release)
+	q.Close()
+	for _, topic := range []string{"a", "b", "c"} {
+		if resp := <-bc.written; resp.Topic != topic {
+			t.Error("Expected topic", topic, "and got", resp.Topic)
+		}
+	}
+}
+
+func TestQueueDropOldest(t *testing.T) {
+	bc := newBlockingCodec()
+	q := newQueuedCodec(bc, 2, QueueDropOldestPush)
+	fillQueue(t, q)
+	if err := q.WriteResponse(&Response{Type: R_RPC, Seq: 1}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, dropped := q.stats(); dropped != 1 {
+		t.Fatal("Expected one dropped push and got", dropped)
+	}
+	close(bc.release)
+	q.Close()
+	for _, topic := range []string{"a", "c", ""} {
+		if resp := <-bc.written; resp.Topic != topic {
+			t.Error("Expected topic", topic, "and got", resp.Topic)
+		}
+	}
+}
+
+func TestQueueBlock(t *testing.T) {
+	bc := newBlockingCodec()
+	q := newQueuedCodec(bc, 2, QueueBlock)
+	fillQueue(t, q)
+	sent := make(chan error, 1)
+	go func() {
+		sent <- q.WriteResponse(&Response{Type: R_PUSH, Topic: "d"}, nil)
+	}()
+	select {
+	case <-sent:
+		t.Fatal("Write did not block with a full queue")
+	case <-time.After(20 * time.Millisecond):
+	}
+	close(bc.release)
+	if err := <-sent; err != nil {
+		t.Fatal(err)
+	}
+	q.Close()
+	if len(bc.written) != 4 {
+		t.Error("Expected 4 responses written and got", len(bc.written))
+	}
+}
+
+func TestQueueDisconnect(t *testing.T) {
+	bc := newBlockingCodec()
+	q := newQueuedCodec(bc, 2, QueueDisconnect)
+	fillQueue(t, q)
+	if err := q.WriteResponse(&Response{Type: R_RPC}, nil); err != ErrQueueFull {
+		t.Fatal("Expected a full queue and got", err)
+	}
+	select {
+	case <-bc.closed:
+	case <-time.After(time.Second):
+		t.Fatal("Connection was not closed")
+	}
+	if err := q.WriteResponse(&Response{Type: R_PUSH}, nil); err != ErrQueueFull {
+		t.Error("Writing after the disconnection should fail and got", err)
+	}
+	close(bc.release)
+}
+
+func TestQueueBlockDisconnect(t *testing.T) {
+	bc := newBlockingCodec()
+	q := newQueuedCodec(bc, 2, QueueBlock)
+	fillQueue(t, q)
+	blocked := make(chan error, 1)
+	go func() {
+		blocked <- q.WriteResponse(&Response{Type: R_PUSH, Topic: "d"}, nil)
+	}()
+	closed := make(chan error, 1)
+	go func() {
+		closed <- q.writeClose(&Response{Type: R_CLOSE, Error: "bye"})
+	}()
+	select {
+	case err := <-closed:
+		if err != ErrQueueFull {
+			t.Error("Expected the full queue to be dropped and got", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Disconnecting waited for room in the queue")
+	}
+	select {
+	case <-bc.closed:
+	case <-time.After(time.Second):
+		t.Fatal("Connection was not closed")
+	}
+	if err := <-blocked; err != ErrQueueFull {
+		t.Error("Expected the blocked write to fail and got", err)
+	}
+	if err := q.Close(); err != ErrQueueFull {
+		t.Error("Expected closing to report the failure and got", err)
+	}
+	close(bc.release)
+}
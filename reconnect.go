@@ -0,0 +1,382 @@
+package clacks
+
+import (
+	"errors"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// ReconnectPolicy defines how a ReconnectingClient recovers from a lost
+// connection.
+type ReconnectPolicy struct {
+	MinBackoff  time.Duration // wait before the first attempt. Defaults to 100ms
+	MaxBackoff  time.Duration // maximum wait between attempts. Defaults to 30s
+	Jitter      float64       // fraction of the wait that is randomized (0 to 1)
+	MaxAttempts int           // attempts before giving up. 0 means forever
+	// Requeue in-flight calls that fail because the connection was lost and
+	// send them again once reconnected. Calls made while disconnected also
+	// wait for the connection. Otherwise they fail right away.
+	Requeue bool
+	// Resume the server session on each reconnection so that the values of
+	// the Context and the pushes sent meanwhile are kept.
+	Resume bool
+}
+
+var DefaultReconnectPolicy = ReconnectPolicy{
+	MinBackoff: 100 * time.Millisecond,
+	MaxBackoff: 30 * time.Second,
+	Jitter:     0.2,
+}
+
+var ErrGaveUp = errors.New("gave up reconnecting")
+
+//Get the time to wait before a reconnection attempt
+func (policy *ReconnectPolicy) backoff(attempt int) time.Duration {
+	minBackoff, maxBackoff := policy.MinBackoff, policy.MaxBackoff
+	if minBackoff <= 0 {
+		minBackoff = DefaultReconnectPolicy.MinBackoff
+	}
+	if maxBackoff <= 0 {
+		maxBackoff = DefaultReconnectPolicy.MaxBackoff
+	}
+	wait := minBackoff
+	for i := 0; i < attempt && wait < maxBackoff; i++ {
+		wait *= 2
+	}
+	if wait > maxBackoff {
+		wait = maxBackoff
+	}
+	if policy.Jitter > 0 {
+		wait -= time.Duration(float64(wait) * policy.Jitter * rand.Float64())
+	}
+	return wait
+}
+
+// ReconnectingClient keeps a Client connected to the server. When the
+// connection is lost it dials again, re-registers the push subscriptions and
+// the services registered in it, and deals with in-flight calls according
+// to its ReconnectPolicy.
+type ReconnectingClient struct {
+	dial     func() (io.ReadWriteCloser, error)
+	policy   ReconnectPolicy
+	cbmgr    *CallbackManager
+	registry *Registry
+
+	lock        sync.Mutex // protects following
+	cond        *sync.Cond // signals changes of client
+	client      *Client    // nil while disconnected
+	types       []interface{}
+	token       string // session token to resume
+	reconnectCB []func(*Client)
+	closing     bool
+	err         error // why the client stopped reconnecting
+	// given to every client
+	interceptors     []ClientInterceptor
+	pushInterceptors []PushInterceptor
+}
+
+// DialReconnecting connects to a server like Dial and keeps reconnecting.
+func DialReconnecting(network, address string, policy ReconnectPolicy) (*ReconnectingClient, error) {
+	return NewReconnectingClient(func() (io.ReadWriteCloser, error) {
+		return net.Dial(network, address)
+	}, policy)
+}
+
+// DialHTTPPathReconnecting connects to a server like DialHTTPPath and keeps
+// reconnecting.
+func DialHTTPPathReconnecting(network, address, path string, policy ReconnectPolicy) (*ReconnectingClient, error) {
+	return NewReconnectingClient(func() (io.ReadWriteCloser, error) {
+		return dialHTTPPath(network, address, path, nil)
+	}, policy)
+}
+
+// NewReconnectingClient creates a client that uses dial to get a connection
+// each time it has to connect. The first connection is made before returning.
+func NewReconnectingClient(dial func() (io.ReadWriteCloser, error), policy ReconnectPolicy) (*ReconnectingClient, error) {
+	rc := &ReconnectingClient{
+		dial:     dial,
+		policy:   policy,
+		cbmgr:    new(CallbackManager),
+		registry: new(Registry),
+	}
+	rc.cond = sync.NewCond(&rc.lock)
+	if err := rc.connect(); err != nil {
+		return nil, err
+	}
+	return rc, nil
+}
+
+//Dial and restore the subscriptions
+func (rc *ReconnectingClient) connect() error {
+	conn, err := rc.dial()
+	if err != nil {
+		return err
+	}
+	client, err := newHandshakeClient(conn, DefaultHandshake, rc.cbmgr, rc.registry)
+	if err != nil {
+		return err
+	}
+	rc.lock.Lock()
+	types := rc.types
+	token := rc.token
+	client.setInterceptors(rc.interceptors, rc.pushInterceptors)
+	rc.lock.Unlock()
+	if rc.policy.Resume {
+		info, err := client.Resume(token)
+		if err != nil {
+			client.Close()
+			return err
+		}
+		rc.lock.Lock()
+		rc.token = info.Token
+		rc.lock.Unlock()
+	}
+	for _, val := range types {
+		client.RegisterType(val)
+	}
+	for _, argType := range rc.cbmgr.argTypes() {
+		if isExportedOrBuiltinType(argType) {
+			client.RegisterType(reflect.Zero(argType).Interface())
+		}
+	}
+	for _, topic := range rc.cbmgr.topics() {
+		if err := client.Call(pubSubServiceName+".Subscribe", topic); err != nil {
+			client.Close()
+			return err
+		}
+	}
+	rc.lock.Lock()
+	if rc.closing {
+		rc.lock.Unlock()
+		client.Close()
+		return ErrShutdown
+	}
+	rc.client = client
+	client.setInterceptors(rc.interceptors, rc.pushInterceptors)
+	callbacks := rc.reconnectCB
+	rc.cond.Broadcast()
+	rc.lock.Unlock()
+	go rc.monitor(client)
+	for _, cb := range callbacks {
+		go cb(client)
+	}
+	return nil
+}
+
+//Wait for the client to lose the connection and reconnect
+func (rc *ReconnectingClient) monitor(client *Client) {
+	<-client.disconnected
+	rc.lock.Lock()
+	if rc.client == client {
+		rc.client = nil
+	}
+	closing := rc.closing
+	rc.cond.Broadcast()
+	rc.lock.Unlock()
+	if closing {
+		return
+	}
+	var err error
+	for attempt := 0; rc.policy.MaxAttempts == 0 || attempt < rc.policy.MaxAttempts; attempt++ {
+		time.Sleep(rc.policy.backoff(attempt))
+		if err = rc.connect(); err == nil || err == ErrShutdown {
+			return
+		}
+		log.Println("reconnecting:", err)
+	}
+	rc.lock.Lock()
+	rc.err = ErrGaveUp
+	rc.cond.Broadcast()
+	rc.lock.Unlock()
+}
+
+//Get the connected client. If wait is set it waits until there is one
+func (rc *ReconnectingClient) current(wait bool) (*Client, error) {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	for {
+		switch {
+		case rc.closing:
+			return nil, ErrShutdown
+		case rc.err != nil:
+			return nil, rc.err
+		case rc.client != nil:
+			return rc.client, nil
+		case !wait:
+			return nil, ErrShutdown
+		}
+		rc.cond.Wait()
+	}
+}
+
+//Wait until client is no longer the connected client
+func (rc *ReconnectingClient) waitReplaced(client *Client) {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	for rc.client == client && !rc.closing && rc.err == nil {
+		rc.cond.Wait()
+	}
+}
+
+//Get the client in use. It is nil while reconnecting
+func (rc *ReconnectingClient) Client() *Client {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	return rc.client
+}
+
+//Send a call and requeue it if the policy says so
+func (rc *ReconnectingClient) run(call *Call) {
+	for {
+		client, err := rc.current(rc.policy.Requeue)
+		if err != nil {
+			call.Error = err
+			call.done()
+			return
+		}
+		sent := <-client.Go(make(chan *Call, 1), call.Method, call.Args...).Done
+		if sent.Error == nil || !rc.policy.Requeue || !client.lostConnection(sent.Error) {
+			call.Error = sent.Error
+			call.Results = sent.Results
+			call.done()
+			return
+		}
+		rc.waitReplaced(client)
+	}
+}
+
+// Go invokes the function asynchronously like Client.Go.
+func (rc *ReconnectingClient) Go(done chan *Call, serviceMethod string, args ...interface{}) *Call {
+	call := new(Call)
+	call.Method = serviceMethod
+	call.Args = args
+	if done == nil {
+		done = make(chan *Call, 10) // buffered.
+	} else if cap(done) == 0 {
+		log.Panic("done channel is unbuffered")
+	}
+	call.Done = done
+	go rc.run(call)
+	return call
+}
+
+// Call invokes the named function, waits for it to complete, and returns its error status.
+func (rc *ReconnectingClient) Call(serviceMethod string, args ...interface{}) error {
+	call := <-rc.Go(make(chan *Call, 1), serviceMethod, args...).Done
+	return call.Error
+}
+
+// Invoke calls a method that returns values like Client.Invoke.
+func (rc *ReconnectingClient) Invoke(serviceMethod string, args ...interface{}) ([]interface{}, error) {
+	call := <-rc.Go(make(chan *Call, 1), serviceMethod, args...).Done
+	return call.Results, call.Error
+}
+
+// Use adds interceptors to the calls like Client.Use. Calls that are
+// requeued go through them again.
+func (rc *ReconnectingClient) Use(interceptors ...ClientInterceptor) {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	rc.interceptors = append(rc.interceptors, interceptors...)
+	if rc.client != nil {
+		rc.client.setInterceptors(rc.interceptors, rc.pushInterceptors)
+	}
+}
+
+// UsePush adds interceptors to the pushes like Client.UsePush.
+func (rc *ReconnectingClient) UsePush(interceptors ...PushInterceptor) {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	rc.pushInterceptors = append(rc.pushInterceptors, interceptors...)
+	if rc.client != nil {
+		rc.client.setInterceptors(rc.interceptors, rc.pushInterceptors)
+	}
+}
+
+//Subscribe to values pushed by the server. See Client.SubscribeToPush
+func (rc *ReconnectingClient) SubscribeToPush(cb interface{}) error {
+	_, err := rc.cbmgr.Subscribe(cb)
+	if err != nil {
+		return err
+	}
+	rc.RegisterType(reflect.Zero(reflect.TypeOf(cb).In(0)).Interface())
+	return nil
+}
+
+//Subscribe to values published to a topic. The subscription is restored
+//after each reconnection. See Client.SubscribeToTopic
+func (rc *ReconnectingClient) SubscribeToTopic(topic string, cb interface{}) error {
+	sid, err := rc.cbmgr.SubscribeToTopic(topic, cb)
+	if err != nil {
+		return err
+	}
+	rc.RegisterType(reflect.Zero(reflect.TypeOf(cb).In(0)).Interface())
+	if err = rc.Call(pubSubServiceName+".Subscribe", topic); err != nil {
+		rc.cbmgr.Unsubscribe(sid)
+	}
+	return err
+}
+
+//Remove all the callbacks for a topic and stop receiving it from the server
+func (rc *ReconnectingClient) UnsubscribeFromTopic(topic string) error {
+	rc.cbmgr.UnsubscribeTopic(topic)
+	return rc.Call(pubSubServiceName+".Unsubscribe", topic)
+}
+
+//Subscribe to the loss of each connection
+func (rc *ReconnectingClient) SubscribeToDisconnect(cb func(*Client)) error {
+	_, err := rc.cbmgr.Subscribe(func(disc disconnectType) {
+		cb(disc.client)
+	})
+	return err
+}
+
+//Subscribe to each new connection after the first one
+func (rc *ReconnectingClient) SubscribeToReconnect(cb func(*Client)) {
+	rc.lock.Lock()
+	defer rc.lock.Unlock()
+	rc.reconnectCB = append(rc.reconnectCB, cb)
+}
+
+//Get the table of types shared by the clients of each connection. See Server.Types
+func (rc *ReconnectingClient) Types() *TypeTable {
+	return rc.registry.getTypes()
+}
+
+//Register a type that the server may send. It is kept across reconnections
+func (rc *ReconnectingClient) RegisterType(val interface{}) {
+	rc.lock.Lock()
+	rc.types = append(rc.types, val)
+	client := rc.client
+	rc.lock.Unlock()
+	if client != nil {
+		client.RegisterType(val)
+	}
+}
+
+//Register methods the server can call. See Client.Register
+func (rc *ReconnectingClient) Register(rcvr interface{}) error {
+	return rc.registry.Register(rcvr)
+}
+
+//Close the connection and stop reconnecting
+func (rc *ReconnectingClient) Close() error {
+	rc.lock.Lock()
+	if rc.closing {
+		rc.lock.Unlock()
+		return ErrShutdown
+	}
+	rc.closing = true
+	client := rc.client
+	rc.cond.Broadcast()
+	rc.lock.Unlock()
+	if client != nil {
+		return client.Close()
+	}
+	return nil
+}
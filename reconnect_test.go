@@ -0,0 +1,137 @@
+package clacks
+
+import (
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// connDialer keeps the last connection so tests can break it
+type connDialer struct {
+	lock sync.Mutex
+	addr string
+	conn net.Conn
+}
+
+func (cd *connDialer) dial() (io.ReadWriteCloser, error) {
+	conn, err := net.Dial("tcp", cd.addr)
+	if err != nil {
+		return nil, err
+	}
+	cd.lock.Lock()
+	cd.conn = conn
+	cd.lock.Unlock()
+	return conn, nil
+}
+
+func (cd *connDialer) breakConn() {
+	cd.lock.Lock()
+	defer cd.lock.Unlock()
+	cd.conn.Close()
+}
+
+func TestBackoff(t *testing.T) {
+	policy := ReconnectPolicy{MinBackoff: time.Second, MaxBackoff: 5 * time.Second}
+	expected := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}
+	for attempt, wait := range expected {
+		if policy.backoff(attempt) != wait {
+			t.Error("Backoff for attempt", attempt, "is", policy.backoff(attempt))
+		}
+	}
+	policy.Jitter = 0.5
+	for attempt := 0; attempt < 10; attempt++ {
+		if wait := policy.backoff(attempt); wait < time.Second/2 || wait > 5*time.Second {
+			t.Error("Jittered backoff out of range", wait)
+		}
+	}
+}
+
+func TestReconnectRequeue(t *testing.T) {
+	srv, addr := startAcceptServer(t, new(DummyService))
+	cd := &connDialer{addr: addr}
+	policy := ReconnectPolicy{MinBackoff: 10 * time.Millisecond, Requeue: true}
+	rc, err := NewReconnectingClient(cd.dial, policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	received := make(chan PushData, 1)
+	if err := rc.SubscribeToTopic("t", func(pd PushData) { received <- pd }); err != nil {
+		t.Fatal(err)
+	}
+	reconnected := make(chan *Client, 1)
+	rc.SubscribeToReconnect(func(c *Client) { reconnected <- c })
+
+	cd.breakConn()
+	rep := new(Reply)
+	if err := rc.Call("DummyService.Sum", Args{1, 2}, rep); err != nil {
+		t.Fatal("Call was not requeued", err)
+	}
+	if rep.Num != 3 {
+		t.Error("Sum does not match")
+	}
+	select {
+	case <-reconnected:
+	case <-time.After(time.Second):
+		t.Fatal("Did not reconnect")
+	}
+	if sent, err := srv.Publish("t", PushData{4, 5}); err != nil || sent != 1 {
+		t.Fatal("Topic subscription was not restored", sent, err)
+	}
+	select {
+	case pd := <-received:
+		if pd.A != 4 || pd.B != 5 {
+			t.Error("Pushed data differs", pd)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Did not receive published data after reconnecting")
+	}
+}
+
+func TestReconnectFail(t *testing.T) {
+	_, addr := startAcceptServer(t, new(DummyService))
+	cd := &connDialer{addr: addr}
+	policy := ReconnectPolicy{MinBackoff: 500 * time.Millisecond}
+	rc, err := NewReconnectingClient(cd.dial, policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	client := rc.Client()
+	cd.breakConn()
+	<-client.disconnected
+	if err := rc.Call("DummyService.Sum", Args{1, 2}, new(Reply)); err != ErrShutdown {
+		t.Error("Call while disconnected should fail and got", err)
+	}
+	rc.Close()
+	if err := rc.Call("DummyService.Sum", Args{1, 2}, new(Reply)); err != ErrShutdown {
+		t.Error("Call after close should fail and got", err)
+	}
+}
+
+func TestReconnectResume(t *testing.T) {
+	srv, addr := startAcceptServer(t, new(SessionService))
+	srv.SetSessionWindow(time.Minute, 0)
+	cd := &connDialer{addr: addr}
+	policy := ReconnectPolicy{MinBackoff: 10 * time.Millisecond, Requeue: true, Resume: true}
+	rc, err := NewReconnectingClient(cd.dial, policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rc.Close()
+	if err := rc.Call("SessionService.Login", Args{42, 0}, new(ClientInfo)); err != nil {
+		t.Fatal(err)
+	}
+	client := rc.Client()
+	cd.breakConn()
+	<-client.disconnected
+	rep := new(Reply)
+	if err := rc.Call("SessionService.User", rep); err != nil {
+		t.Fatal(err)
+	}
+	if rep.Num != 42 {
+		t.Error("Session was not resumed after reconnecting")
+	}
+}
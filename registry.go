@@ -5,6 +5,7 @@ import (
 
 	"reflect"
 	"strconv"
+	"strings"
 	"sync"
 	"unicode"
 	"unicode/utf8"
@@ -25,6 +26,9 @@ type methodData struct {
 	args        []methodArgument
 	numCalls    uint
 	numPointers uint
+	results     []reflect.Type // values returned before the error
+	stream      bool           // last argument is a *Stream
+	recvStream  bool           // last argument is a *RecvStream
 }
 
 type serviceData struct {
@@ -39,6 +43,8 @@ type Registry struct {
 	registeredTypes map[string]bool
 	midCounter      uint64
 	lock            sync.RWMutex
+	types           *TypeTable // names of the argument types
+	typesOnce       sync.Once
 }
 
 // Is this an exported - upper case - name?
@@ -58,10 +64,22 @@ func isExportedOrBuiltinType(t reflect.Type) bool {
 }
 
 func (registry *Registry) RegisterType(val interface{}) {
-	new(gobCodec).Register(val)
+	registry.getTypes().Register(val)
+}
+
+//Get the type table of the registry. Servers and clients share theirs with it
+func (registry *Registry) getTypes() *TypeTable {
+	registry.typesOnce.Do(func() {
+		if registry.types == nil {
+			registry.types = NewTypeTable()
+		}
+	})
+	return registry.types
 }
 
 var contextType = reflect.TypeOf(NewContext())
+var streamType = reflect.TypeOf((*Stream)(nil))
+var recvStreamType = reflect.TypeOf((*RecvStream)(nil))
 
 func (registry *Registry) searchMethodArguments(methodType reflect.Type) ([]methodArgument, uint, error) {
 	exported := make([]methodArgument, 0)
@@ -78,6 +96,13 @@ func (registry *Registry) searchMethodArguments(methodType reflect.Type) ([]meth
 	//Check the rest of args
 	for i := 2; i < methodType.NumIn(); i++ {
 		argType := methodType.In(i)
+		//Streams are not sent over the wire
+		if argType == streamType || argType == recvStreamType {
+			if i != methodType.NumIn()-1 {
+				return exported, 0, errors.New(argType.String() + " must be the last argument")
+			}
+			break
+		}
 		elem := argType
 		if argType.Kind() == reflect.Ptr {
 			numPointers += 1
@@ -108,6 +133,23 @@ func (registry *Registry) searchMethodArguments(methodType reflect.Type) ([]meth
 	return exported, numPointers, nil
 }
 
+//Get the types returned before the error. They are sent back after the
+//pointer arguments
+func (registry *Registry) searchMethodResults(methodType reflect.Type) ([]reflect.Type, error) {
+	var results []reflect.Type
+	if methodType.NumOut() > 1 {
+		results = make([]reflect.Type, methodType.NumOut()-1)
+	}
+	for i := range results {
+		results[i] = methodType.Out(i)
+		if !isExportedOrBuiltinType(results[i]) {
+			return nil, errors.New("type not exported: " + results[i].String())
+		}
+		registry.RegisterType(reflect.Zero(results[i]).Interface())
+	}
+	return results, nil
+}
+
 // exportedMethods returns suitable Rpc methods of typ, it will report
 // error using log if reportErr is true.
 func (registry *Registry) exportedMethods(typ reflect.Type) (map[string]*methodData, error) {
@@ -124,54 +166,153 @@ func (registry *Registry) exportedMethods(typ reflect.Type) (map[string]*methodD
 		if err != nil {
 			return methods, errors.New(methodName + " has an invalid argument: " + err.Error())
 		}
-		if methodType.NumOut() != 1 {
-			return methods, errors.New(methodName + " can only return one value and it has to be an error")
+		if methodType.NumOut() == 0 {
+			return methods, errors.New(methodName + " has to return an error as last value")
 		}
-		// The return type of the methodObj must be error.
+		// The last return type of the methodObj must be error.
 		if returnType := methodType.Out(methodType.NumOut() - 1); returnType != typeOfError {
 			return methods, errors.New("methodObj" + methodName + "returns" + returnType.String() + "not error as last return value")
 		}
-		methods[methodName] = &methodData{method: methodObj, args: methodArgs, numPointers: numPointers}
+		results, err := registry.searchMethodResults(methodType)
+		if err != nil {
+			return methods, errors.New(methodName + " has an invalid return value: " + err.Error())
+		}
+		mData := &methodData{method: methodObj, args: methodArgs, numPointers: numPointers, results: results}
+		lastArg := methodType.In(methodType.NumIn() - 1)
+		mData.stream = lastArg == streamType
+		mData.recvStream = lastArg == recvStreamType
+		methods[methodName] = mData
 	}
 	return methods, nil
 }
 
 func (svc *serviceData) ExecuteMethod(mData *methodData, ctx *Context, args []reflect.Value, cb func([]reflect.Value, string)) {
-	//func (s *service) call(server *Server, sending *sync.Mutex, mtype *methodType, req *Request, argv, replyv reflect.Value, codec ServerCodec) {
+	svc.executeMethod(mData, ctx, args, nil, cb)
+}
+
+//Execute a method. extra holds the arguments that are not sent over the wire
+//like streams and goes after the rest of arguments.
+func (svc *serviceData) executeMethod(mData *methodData, ctx *Context, args []reflect.Value, extra []reflect.Value, cb func([]reflect.Value, string)) {
+	rargs, err := svc.call(mData, ctx, args, extra)
+	errMsg := ""
+	if err != nil {
+		errMsg = err.Error()
+	}
+	cb(rargs, errMsg)
+}
+
+//Call a method and return the values to send back, the pointer arguments
+//followed by the values it returned, and its error
+func (svc *serviceData) call(mData *methodData, ctx *Context, args []reflect.Value, extra []reflect.Value) ([]reflect.Value, error) {
 	mData.Lock()
 	mData.numCalls++
 	mData.Unlock()
 	function := mData.method.Func
-	argsRcvr := make([]reflect.Value, len(args)+2)
+	argsRcvr := make([]reflect.Value, len(args)+len(extra)+2)
 	argsRcvr[0] = svc.rcvr
 	argsRcvr[1] = reflect.ValueOf(ctx)
+	if len(args) != len(mData.args) {
+		return nil, NewError(CodeInvalidArgument, "Mismatch in the number of arguments! Expected "+strconv.Itoa(len(mData.args)))
+	}
 	for iPos, arg := range args {
 		rtyp, etyp := arg.Type(), mData.args[iPos].typ
 		if !reflect.DeepEqual(rtyp, etyp) {
-			cb(nil, "Argument "+strconv.Itoa(iPos)+" if of type "+rtyp.String()+" and the expected type is "+etyp.String())
-			return
+			return nil, NewError(CodeInvalidArgument, "Argument "+strconv.Itoa(iPos)+" if of type "+rtyp.String()+" and the expected type is "+etyp.String())
 		}
 		//0 is rvcr and 1 is the context
 		argsRcvr[iPos+2] = arg
 	}
+	copy(argsRcvr[len(args)+2:], extra)
 	// Invoke the method, providing a new value for the reply.
 	returnValues := function.Call(argsRcvr)
-	// The return value for the method is an error.
-	errInter := returnValues[0].Interface()
-	errMsg := ""
-	if errInter != nil {
-		errMsg = errInter.(error).Error()
+	// The last return value for the method is an error.
+	var err error
+	if errInter := returnValues[len(returnValues)-1].Interface(); errInter != nil {
+		err = errInter.(error)
 	}
-	rargs := make([]reflect.Value, mData.numPointers)
+	rargs := make([]reflect.Value, mData.numPointers, int(mData.numPointers)+len(mData.results))
 	rPos := 0
+	//args do not hold the receiver, so the first one is sent back too
 	for iPos, methodArg := range mData.args {
-		//First is rvcr
-		if methodArg.typ.Kind() == reflect.Ptr && iPos > 0 {
+		if methodArg.typ.Kind() == reflect.Ptr {
 			rargs[rPos] = args[iPos]
 			rPos += 1
 		}
 	}
-	cb(rargs, errMsg)
+	rargs = append(rargs, returnValues[:len(returnValues)-1]...)
+	return rargs, err
+}
+
+//Find the service and method for a "Service.Method" string
+func (registry *Registry) lookup(serviceMethod string) (svcData *serviceData, mData *methodData, err error) {
+	dot := strings.LastIndex(serviceMethod, ".")
+	if dot < 0 {
+		err = NewError(CodeUnknownMethod, "service/method request ill-formed: "+serviceMethod)
+		return
+	}
+	serviceName := serviceMethod[:dot]
+	methodName := serviceMethod[dot+1:]
+
+	svcData, mData = registry.GetServiceMethod(serviceName, methodName)
+	if svcData == nil {
+		err = NewError(CodeUnknownMethod, "Can't find service "+serviceName)
+		return
+	}
+	if mData == nil {
+		err = NewError(CodeUnknownMethod, "Can't find method "+methodName+" for service "+serviceName)
+	}
+	return
+}
+
+//Read the body of a call and convert it to the arguments a method expects
+func readArguments(codec Codec, mData *methodData) (args []reflect.Value, err error) {
+	//Codecs that do not carry types, like JSON, decode into these
+	ifaces := make([]interface{}, len(mData.args))
+	for iPos, mArg := range mData.args {
+		ifaces[iPos] = reflect.New(mArg.typ).Interface()
+	}
+	err = codec.ReadBody(&ifaces)
+	if err != nil {
+		return
+	}
+	numArgs := len(mData.args)
+	if len(ifaces) != numArgs {
+		err = NewError(CodeInvalidArgument, "Mismatch in the number of arguments! Expected "+strconv.Itoa(numArgs))
+		return
+	}
+	args = make([]reflect.Value, numArgs)
+	for iPos, mArg := range mData.args {
+		argv := reflect.ValueOf(ifaces[iPos])
+		isPtr := mArg.typ.Kind() == reflect.Ptr
+		if !argv.IsValid() && !isPtr {
+			err = NewError(CodeInvalidArgument, "Argument "+strconv.Itoa(iPos)+" is nil")
+			return
+		}
+		//Registered types arrive as a pointer to the expected type and
+		//builtin ones without the pointers they were sent with
+		if argv.Kind() == reflect.Ptr && argv.Type() != mArg.typ {
+			argv = argv.Elem()
+		} else if isPtr && argv.IsValid() && argv.Type() == mArg.typ.Elem() {
+			ptr := reflect.New(argv.Type())
+			ptr.Elem().Set(argv)
+			argv = ptr
+		}
+		//Codecs can not tell a pointer to an empty value, like a nil slice,
+		//from a nil pointer. Methods always get something to fill
+		if isPtr && (!argv.IsValid() || argv.Kind() == reflect.Ptr && argv.IsNil()) {
+			argv = reflect.New(mArg.typ.Elem())
+		}
+		args[iPos] = argv
+	}
+	return
+}
+
+func valuesToInterfaces(values []reflect.Value) []interface{} {
+	ifaces := make([]interface{}, len(values))
+	for iPos, value := range values {
+		ifaces[iPos] = value.Interface()
+	}
+	return ifaces
 }
 
 func (registry *Registry) GetServiceMethod(serviceName string, methodName string) (service *serviceData, method *methodData) {
@@ -199,23 +340,60 @@ func (registry *Registry) RegisterWithName(rcvr interface{}, sname string) error
 	if registry.svcMap == nil {
 		registry.svcMap = make(map[string]*serviceData)
 	}
+	s, err := registry.newService(rcvr, sname)
+	if err != nil {
+		return err
+	}
+	if _, present := registry.svcMap[sname]; present {
+		return errors.New("Service already defined: " + sname)
+	}
+	registry.svcMap[s.name] = s
+	return nil
+}
+
+//Unregister a service. Calls in flight finish but new ones can not find it
+func (registry *Registry) Unregister(sname string) error {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+	if _, present := registry.svcMap[sname]; !present {
+		return NewError(CodeNotFound, "Can't find service "+sname)
+	}
+	delete(registry.svcMap, sname)
+	return nil
+}
+
+//Replace the receiver of a service. Calls in flight finish with the old
+//receiver and new ones go to rcvr. The methods can be different
+func (registry *Registry) Replace(sname string, rcvr interface{}) error {
+	registry.lock.Lock()
+	defer registry.lock.Unlock()
+	if _, present := registry.svcMap[sname]; !present {
+		return NewError(CodeNotFound, "Can't find service "+sname)
+	}
+	s, err := registry.newService(rcvr, sname)
+	if err != nil {
+		return err
+	}
+	registry.svcMap[sname] = s
+	return nil
+}
+
+//Build the service data of a receiver. The lock of the registry has to be held
+func (registry *Registry) newService(rcvr interface{}, sname string) (*serviceData, error) {
 	s := new(serviceData)
 	s.typ = reflect.TypeOf(rcvr)
 	s.rcvr = reflect.ValueOf(rcvr)
 	indirectType := reflect.Indirect(s.rcvr).Type()
 	funcName := indirectType.Name()
 	if !isExported(funcName) {
-		return errors.New("Register: type " + funcName + " is not exported")
-	}
-	if _, present := registry.svcMap[sname]; present {
-		return errors.New("Service already defined: " + sname)
+		return nil, errors.New("Register: type " + funcName + " is not exported")
 	}
 	s.name = sname
 
 	// Install the methods
 	methods, err := registry.exportedMethods(s.typ)
 	if err != nil {
-		return errors.New(sname + "Cannot be registered: " + err.Error())
+		return nil, errors.New(sname + "Cannot be registered: " + err.Error())
 	}
 	s.methods = methods
 
@@ -225,12 +403,11 @@ func (registry *Registry) RegisterWithName(rcvr interface{}, sname string) error
 		methods, err := registry.exportedMethods(reflect.PtrTo(s.typ))
 		switch {
 		case len(methods) != 0:
-			return errors.New("Type " + sname + " has no exported methods of suitable type (hint: pass a pointer to value of that type)")
+			return nil, errors.New("Type " + sname + " has no exported methods of suitable type (hint: pass a pointer to value of that type)")
 		case err != nil:
-			return err
+			return nil, err
 		}
-		return errors.New("Type " + sname + " has no exported methods of suitable type")
+		return nil, errors.New("Type " + sname + " has no exported methods of suitable type")
 	}
-	registry.svcMap[s.name] = s
-	return nil
-}
\ No newline at end of file
+	return s, nil
+}
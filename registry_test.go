@@ -5,6 +5,7 @@ import (
 	"reflect"
 	"strconv"
 	"testing"
+	"time"
 )
 
 type privateStuff struct{}
@@ -180,6 +181,28 @@ func TestGetServiceMethod(t *testing.T) {
 	}
 }
 
+type FirstPointerService struct{}
+
+func (fp *FirstPointerService) Fill(ctx *Context, td *TestData) error {
+	td.A = 7
+	return nil
+}
+
+func TestCallFirstPointer(t *testing.T) {
+	registry := new(Registry)
+	if err := registry.Register(new(FirstPointerService)); err != nil {
+		t.Fatal(err)
+	}
+	svcData, mData := registry.GetServiceMethod("FirstPointerService", "Fill")
+	td := new(TestData)
+	svcData.ExecuteMethod(mData, NewContext(), []reflect.Value{reflect.ValueOf(td)}, func(rargs []reflect.Value, errMsg string) {
+		//The pointer arguments are sent back, the first one too
+		if len(rargs) != 1 || !rargs[0].IsValid() || rargs[0].Interface() != td || td.A != 7 {
+			t.Errorf("Unexpected returned args %v %q", rargs, errMsg)
+		}
+	})
+}
+
 func TestCall(t *testing.T) {
 	registry := new(Registry)
 	mysp := new(MyService)
@@ -218,3 +241,62 @@ func TestCall(t *testing.T) {
 		}
 	})
 }
+
+type VersionService struct {
+	version int
+	release chan bool
+}
+
+func (vs *VersionService) Version(ctx *Context, r *Reply) error {
+	if vs.release != nil {
+		<-vs.release
+	}
+	r.Num = vs.version
+	return nil
+}
+
+func TestUnregisterAndReplace(t *testing.T) {
+	old := &VersionService{version: 1, release: make(chan bool)}
+	srv, addr := startAcceptServer(t, old)
+	client, err := Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("dialing", err)
+	}
+	defer client.Close()
+	//Wait for the call to reach the old receiver before replacing it
+	oldRep := &Reply{}
+	oldCall := client.Go(make(chan *Call, 1), "VersionService.Version", oldRep)
+	_, mData := srv.getRegistry().GetServiceMethod("VersionService", "Version")
+	for calls := uint(0); calls == 0; time.Sleep(time.Millisecond) {
+		mData.Lock()
+		calls = mData.numCalls
+		mData.Unlock()
+	}
+	if err = srv.Replace("VersionService", &VersionService{version: 2}); err != nil {
+		t.Fatal(err)
+	}
+	rep := &Reply{}
+	if err = client.Call("VersionService.Version", rep); err != nil || rep.Num != 2 {
+		t.Error("Expected the new receiver and got", rep.Num, err)
+	}
+	old.release <- true
+	if call := <-oldCall.Done; call.Error != nil || oldRep.Num != 1 {
+		t.Error("Expected the old receiver to finish the call and got", oldRep.Num, call.Error)
+	}
+	if err = srv.Replace("VersionService", MyService{}); err == nil {
+		t.Error("Replaced a service with a receiver without methods")
+	}
+	if err = srv.Unregister("VersionService"); err != nil {
+		t.Fatal(err)
+	}
+	err = client.Call("VersionService.Version", rep)
+	if err == nil || err.Error() != "Can't find service VersionService" {
+		t.Error("Expected the service to be gone and got", err)
+	}
+	if err = srv.Unregister("VersionService"); err == nil {
+		t.Error("Unregistered a service twice")
+	}
+	if err = srv.Replace("VersionService", old); err == nil {
+		t.Error("Replaced a service that is not registered")
+	}
+}
@@ -3,22 +3,41 @@ package clacks
 import "sync"
 
 const (
-	R_RPC  = iota //Normal RPC request
-	R_PUSH        //Push async data to client
-	R_DATA        //Send data to client
+	R_RPC    = iota //Normal RPC request
+	R_PUSH          //Push async data to client
+	R_DATA          //Send data to client
+	R_CLOSE         //Server is closing the connection. Error holds the reason
+	R_CALL          //Server calls a method registered in the client
+	R_REPLY         //Client replies to a R_CALL
+	R_END           //Client has finished sending R_DATA for a call
+	R_RESUME        //Client wants to resume a session
+	R_ACK           //Client acknowledges the R_PUSH in the body
 )
 
 type Request struct {
-	Method string
-	Seq    uint64
-	next   *Request
+	Type   uint8  `json:"type"`
+	Method string `json:"method,omitempty"`
+	Seq    uint64 `json:"seq"`
+	Error  string `json:"error,omitempty"` //Error of a R_REPLY
+	//Metadata of a R_RPC, like the one added by client interceptors
+	Metadata map[string]string `json:"metadata,omitempty"`
+	next     *Request
 }
 
 type Response struct {
-	Type  uint8
-	Seq   uint64
-	Error string
-	next  *Response
+	Type    uint8  `json:"type"`
+	Seq     uint64 `json:"seq"`
+	Error   string `json:"error,omitempty"`
+	Topic   string `json:"topic,omitempty"`   //Topic of a R_PUSH. Empty if it was sent only to one client
+	Method  string `json:"method,omitempty"`  //Method of a R_CALL
+	PushSeq uint64 `json:"pushSeq,omitempty"` //Sequence of a R_PUSH to acknowledge. 0 if no ack is expected
+	//Code, Retryable, Causes and HasDetail are set for the errors that have a
+	//code. The body holds the detail if HasDetail is set
+	Code      string       `json:"code,omitempty"`
+	Retryable bool         `json:"retryable,omitempty"`
+	Causes    []ErrorCause `json:"causes,omitempty"`
+	HasDetail bool         `json:"hasDetail,omitempty"`
+	next      *Response
 }
 
 type ReCache struct {
@@ -1,6 +1,7 @@
 package clacks
 
 import (
+	"crypto/tls"
 	"errors"
 	"io"
 	"log"
@@ -8,8 +9,9 @@ import (
 	"net/http"
 	"reflect"
 	"strconv"
-	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const (
@@ -25,8 +27,34 @@ type Server struct {
 	numConn   uint64
 	lock      sync.Mutex
 	registry  *Registry
+	conns     map[uint64]*connection
+	topics    topicMap
+	sessions  sessionMap
 	codecCB   codecFunc
 	contextCB contextFunc
+	// outbound queue of each connection
+	queueSize   int
+	queuePolicy QueuePolicy
+	// acknowledgement of pushes
+	ackTimeout time.Duration
+	ackCB      PushAckFunc
+	// compression of negotiated connections
+	compressLevel     int
+	compressThreshold int
+	// limits of negotiated connections
+	maxHeaderSize    int
+	maxBodySize      int
+	requireHandshake bool
+	// accept WebSocket requests from their Origin. nil accepts the same host
+	originCheck func(req *http.Request) bool
+	// values of a RecvStream waiting for the method
+	streamBuffer int
+	// handshake of new connections
+	handshakeTimeout time.Duration
+	codecs           []string // allowed in the handshake. nil allows all
+	compressions     []string // allowed in the handshake. nil allows all
+	// wrap the calls to the services
+	interceptors []Interceptor
 }
 
 /* Generate codec */
@@ -37,6 +65,14 @@ func GenerateCodec(conn io.ReadWriteCloser) Codec {
 	return codec
 }
 
+// GenerateGobCodec creates a gob codec that does not compress. It is the one
+// negotiated as gob in the handshake
+func GenerateGobCodec(conn io.ReadWriteCloser) Codec {
+	codec := &gobCodec{}
+	codec.setPlainRWC(conn)
+	return codec
+}
+
 /* Methods to set callbacks by user */
 
 func (server *Server) CodecFunc(c codecFunc) {
@@ -56,15 +92,56 @@ func (server *Server) ProcessConnection(conn net.Conn) {
 	cancel := ctx.GetCancelFunc()
 	defer cancel()
 	server.lock.Lock()
-	ctx.setClientId(server.numConn)
+	clientId := server.numConn
 	server.numConn += 1
 	server.lock.Unlock()
+	ctx.setClientId(clientId)
 	ctx.setConn(conn)
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		//Clients that connect and send nothing do not keep the connection
+		server.lock.Lock()
+		timeout := server.handshakeTimeout
+		server.lock.Unlock()
+		if timeout > 0 {
+			tlsConn.SetDeadline(time.Now().Add(timeout))
+		}
+		err := tlsConn.Handshake()
+		tlsConn.SetDeadline(time.Time{})
+		if err != nil {
+			log.Println("TLS handshake:", err)
+			conn.Close()
+			return
+		}
+	}
+	if state := tlsState(conn); state != nil {
+		ctx.setTLSState(state)
+	}
+	cConn := &countingConn{Conn: conn}
+	codec, frames, err := server.handshake(cConn)
+	if err != nil {
+		if err != io.EOF {
+			log.Println("handshake:", err)
+		}
+		conn.Close()
+		return
+	}
+	codec.SetTypeTable(server.Types())
+	server.lock.Lock()
+	if server.queueSize > 0 {
+		codec = newQueuedCodec(codec, server.queueSize, server.queuePolicy)
+	}
+	server.lock.Unlock()
+	defer codec.Close()
+	sConn := newConnection(server, clientId, ctx, cConn, codec)
+	sConn.frames = frames
+	ctx.setConnection(sConn)
+	ctx.setSession(server.sessions.create(sConn))
+	server.addConnection(sConn)
+	defer server.removeConnection(sConn)
+	defer sConn.close()
 	if server.contextCB != nil {
 		server.contextCB(ctx)
 	}
-	codec := server.codecCB(conn)
-	defer codec.Close()
 	for server.processOne(ctx, codec) {
 	}
 }
@@ -72,38 +149,149 @@ func (server *Server) ProcessConnection(conn net.Conn) {
 func (server *Server) processOne(ctx *Context, codec Codec) bool {
 	req, alive, svc, mData, args, err := server.readRequest(codec)
 	if err != nil {
+		if _, ok := err.(ProtocolError); ok {
+			server.protocolError(ctx, err)
+			return false
+		}
 		if !alive {
 			return false
 		}
 		// send a response if we actually managed to read a header.
 		if req != nil {
-			server.sendResponse(req, codec, err.Error(), nil)
+			server.sendError(req, codec, err)
 		}
-	} else {
-		go svc.ExecuteMethod(mData, ctx, args, func(rargs []reflect.Value, errMsg string) {
-			server.sendResponse(req, codec, errMsg, rargs)
-		})
+		return true
+	}
+	conn := ctx.getConnection()
+	if req.Type == R_RPC {
+		if conn != nil {
+			conn.used = true
+		}
+		server.executeRequest(conn, ctx, codec, req, svc, mData, args)
+		return true
+	}
+	if conn == nil {
+		log.Println("Request type", req.Type, "requires a connection")
+		server.freeRequest(req)
+		return false
+	}
+	if req.Type == R_RESUME {
+		//The response frees the request
+		if err = server.processResume(conn, req); err != nil {
+			log.Println("resuming session:", err)
+			return false
+		}
+		return true
+	}
+	defer server.freeRequest(req)
+	switch req.Type {
+	case R_REPLY:
+		err = conn.processReply(req)
+	case R_DATA:
+		err = conn.processData(req)
+	case R_END:
+		conn.processEnd(req)
+	case R_ACK:
+		err = conn.processAck(req)
+	default:
+		err = errors.New("Unknown request type " + strconv.Itoa(int(req.Type)))
+	}
+	if err != nil {
+		log.Println("processing request:", err)
+		if _, ok := err.(ProtocolError); ok {
+			server.protocolError(ctx, err)
+		}
+		return false
 	}
 	return true
 }
 
-func (server *Server) sendResponse(req *Request, codec Codec, errMsg string, rargs []reflect.Value) (err error) {
+//Tell the client the rule it broke before the connection is closed
+func (server *Server) protocolError(ctx *Context, err error) {
+	if conn := ctx.getConnection(); conn != nil {
+		conn.disconnect("Protocol error: " + err.Error())
+	}
+}
+
+//Execute the method of a R_RPC request through the interceptors in its own
+//goroutine
+func (server *Server) executeRequest(conn *connection, ctx *Context, codec Codec, req *Request, svc *serviceData, mData *methodData, args []reflect.Value) {
+	seq := req.Seq
+	var extra []reflect.Value
+	switch {
+	case mData.stream:
+		extra = []reflect.Value{reflect.ValueOf(&Stream{server: server, codec: codec, seq: seq})}
+	case mData.recvStream:
+		server.lock.Lock()
+		stream := newRecvStream(server.streamBuffer)
+		server.lock.Unlock()
+		if conn != nil {
+			conn.addStream(seq, stream)
+		} else {
+			stream.finish(io.EOF)
+		}
+		extra = []reflect.Value{reflect.ValueOf(stream)}
+	}
+	if conn != nil {
+		atomic.AddInt64(&conn.inFlight, 1)
+	}
+	handler := server.intercept(func(ctx *Context, method string, args []reflect.Value) ([]reflect.Value, error) {
+		return svc.call(mData, ctx, args, extra)
+	})
+	//The call gets its own context if the client sent metadata with it
+	callCtx := ctx.forCall(req.Metadata)
+	go func() {
+		rargs, err := handler(callCtx, req.Method, args)
+		if conn != nil && mData.recvStream {
+			conn.removeStream(seq)
+		}
+		if err != nil {
+			server.sendError(req, codec, err)
+		} else {
+			server.sendResponse(req, codec, "", rargs)
+		}
+		if conn != nil {
+			atomic.AddInt64(&conn.inFlight, -1)
+		}
+	}()
+}
+
+func (server *Server) sendResponse(req *Request, codec Codec, errMsg string, rargs []reflect.Value) error {
 	resp := server.getResponse()
-	defer server.freeRequest(req)
-	defer server.freeResponse(resp)
-	resp.Type = R_RPC
-	resp.Seq = req.Seq
 	resp.Error = errMsg
 	if len(resp.Error) > 0 {
-		err = codec.WriteResponse(resp, nil)
-	} else {
-		ifaces := make([]interface{}, len(rargs))
-		for iPos, argv := range rargs {
-			ifaces[iPos] = argv.Interface()
+		return server.writeResponse(req, codec, resp, nil)
+	}
+	return server.writeResponse(req, codec, resp, valuesToInterfaces(rargs))
+}
+
+//Send the error of a call. Errors that are or wrap an *Error keep its code,
+//retryable flag and detail
+func (server *Server) sendError(req *Request, codec Codec, callErr error) error {
+	resp := server.getResponse()
+	resp.Error = callErr.Error()
+	var sErr *Error
+	if !errors.As(callErr, &sErr) || sErr.Code == "" {
+		return server.writeResponse(req, codec, resp, nil)
+	}
+	resp.Code = string(sErr.Code)
+	resp.Retryable = sErr.Retryable
+	resp.Causes = errorCauses(callErr)
+	if sErr.Detail != nil {
+		if body, err := pushBody(sErr.Detail); err == nil {
+			resp.HasDetail = true
+			return server.writeResponse(req, codec, resp, body)
 		}
-		err = codec.WriteResponse(resp, ifaces)
 	}
-	if err != nil {
+	return server.writeResponse(req, codec, resp, nil)
+}
+
+func (server *Server) writeResponse(req *Request, codec Codec, resp *Response, body interface{}) (err error) {
+	defer server.freeRequest(req)
+	defer server.freeResponse(resp)
+	resp.Type = R_RPC
+	resp.Seq = req.Seq
+	if err = codec.WriteResponse(resp, body); err != nil {
 		log.Println("writing response:", err)
 	}
 	return
@@ -118,21 +306,11 @@ func (server *Server) readRequest(codec Codec) (req *Request, alive bool, svcDat
 		log.Println("Error processing read request header: ", err)
 		return
 	}
-	//Fill the interface array with the expected types
-	ifaces := make([]interface{}, 0)
-	err = codec.ReadBody(&ifaces)
-	if err != nil {
-		return
-	}
-	numArgs := len(mData.args)
-	if len(ifaces) != numArgs {
-		err = errors.New("Mismatch in the number of arguments! Expected " + strconv.Itoa(numArgs))
+	if req.Type != R_RPC {
+		//The body is read by whoever processes this type of request
 		return
 	}
-	args = make([]reflect.Value, numArgs)
-	for iPos, _ := range mData.args {
-		args[iPos] = reflect.ValueOf(ifaces[iPos]).Elem()
-	}
+	args, err = readArguments(codec, mData)
 	return
 }
 
@@ -140,36 +318,30 @@ func (server *Server) readRequestHeader(codec Codec) (req *Request, alive bool,
 	req = server.getRequest()
 	err = codec.ReadRequestHeader(req)
 	if err != nil {
-		if err == io.EOF || err == io.ErrUnexpectedEOF {
+		if _, ok := err.(ProtocolError); ok || err == io.EOF || err == io.ErrUnexpectedEOF {
 			return
 		}
 		err = errors.New("server cannot decode request: " + err.Error())
 		return
 	}
 	alive = true
-	dot := strings.LastIndex(req.Method, ".")
-	if dot < 0 {
-		err = errors.New("service/method request ill-formed: " + req.Method)
-		return
-	}
-	serviceName := req.Method[:dot]
-	methodName := req.Method[dot+1:]
-
-	svcData, mData = server.registry.GetServiceMethod(serviceName, methodName)
-	if svcData == nil {
-		err = errors.New("Can't find service " + serviceName)
+	if req.Type != R_RPC {
 		return
 	}
-	if mData == nil {
-		err = errors.New("Can't find method " + methodName + " for service " + serviceName)
-	}
+	svcData, mData, err = server.getRegistry().lookup(req.Method)
 	return
 }
 
 /*
 	HTTP bridge
 */
+// ServeHTTP processes connections made with CONNECT, like DialHTTP does, and
+// WebSocket upgrades, for DialWebSocket and browsers.
 func (server *Server) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if headerHasToken(req.Header, "Upgrade", "websocket") {
+		server.serveWebSocket(w, req)
+		return
+	}
 	if req.Method != "CONNECT" {
 		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 		w.WriteHeader(http.StatusMethodNotAllowed)
@@ -190,13 +362,40 @@ func (server *Server) HandleHTTP() {
 	http.Handle(RPCPath, server)
 }
 
-func (server *Server) Register(endpoint interface{}) error {
+//Get the registry creating it with the built-in services if needed
+func (server *Server) getRegistry() *Registry {
 	server.lock.Lock()
+	defer server.lock.Unlock()
 	if server.registry == nil {
 		server.registry = new(Registry)
+		server.registry.RegisterWithName(&PubSub{server}, pubSubServiceName)
+		server.registry.RegisterWithName(&Introspection{server}, introspectionServiceName)
 	}
-	server.lock.Unlock()
-	return server.registry.Register(endpoint)
+	return server.registry
+}
+
+// Types is the table with the names the types of the values sent as
+// interfaces travel with, like pushes. Register in it the types to send with
+// another name.
+func (server *Server) Types() *TypeTable {
+	return server.getRegistry().getTypes()
+}
+
+func (server *Server) Register(endpoint interface{}) error {
+	return server.getRegistry().Register(endpoint)
+}
+
+// Unregister removes a service while the server runs. Calls in flight
+// finish.
+func (server *Server) Unregister(name string) error {
+	return server.getRegistry().Unregister(name)
+}
+
+// Replace swaps the receiver of a service while the server runs, like when
+// reloading it. Calls in flight finish with the old receiver and new ones go
+// to the new one.
+func (server *Server) Replace(name string, endpoint interface{}) error {
+	return server.getRegistry().Replace(name, endpoint)
 }
 
 // Accept accepts connections on the listener and serves requests
@@ -226,5 +425,5 @@ func (server *Server) ListenAndServeTLS(addr string, certFile string, keyFile st
 }
 
 func NewServer() *Server {
-	return &Server{codecCB: GenerateCodec}
+	return &Server{codecCB: GenerateCodec, queueSize: defaultQueueSize, handshakeTimeout: DefaultHandshakeTimeout, streamBuffer: DefaultStreamBuffer}
 }
@@ -54,6 +54,54 @@ func startNewServer() {
 	log.Println("Test HTTP RPC server listening on", httpAddr)
 }
 
+func startAcceptServer(t *testing.T, endpoints ...interface{}) (*Server, string) {
+	srv := NewServer()
+	for _, endpoint := range endpoints {
+		if err := srv.Register(endpoint); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen tcp :0: %v", err)
+	}
+	go srv.Accept(l)
+	return srv, l.Addr().String()
+}
+
+type PushService struct{}
+
+type ClientInfo struct {
+	Id uint64
+}
+
+func (ps *PushService) WhoAmI(ctx *Context, ci *ClientInfo) error {
+	ci.Id = ctx.GetClientId()
+	return nil
+}
+
+func (ps *PushService) PushMe(ctx *Context, a Args) error {
+	return ctx.Push(PushData{uint(a.A), uint(a.B)})
+}
+
+type ResultService struct{}
+
+func (rs *ResultService) Divide(ctx *Context, a Args) (Reply, error) {
+	if a.B == 0 {
+		return Reply{}, errors.New("Division by zero")
+	}
+	return Reply{a.A / a.B}, nil
+}
+
+func (rs *ResultService) DivMod(ctx *Context, a Args, r *Reply) (int, string, error) {
+	r.Num = a.A / a.B
+	return a.A % a.B, "remainder", nil
+}
+
+func (rs *ResultService) Find(ctx *Context, a Args) (*Reply, error) {
+	return nil, nil
+}
+
 // END HELPERS
 func TestReadRequestHeader(t *testing.T) {
 	server := new(Server)
@@ -156,6 +204,7 @@ func TestSendResponse(t *testing.T) {
 	}
 	codec := new(gobCodec)
 	codec.SetRWC(&RWCMock{})
+	codec.SetTypeTable(server.Types())
 	req := &Request{Method: "DummyService.Sum", Seq: 123}
 	args := []reflect.Value{reflect.ValueOf(&Reply{1})}
 	err := server.sendResponse(req, codec, "", args)
@@ -177,7 +226,8 @@ func TestSendResponse(t *testing.T) {
 	if err != nil {
 		t.Error(err)
 	}
-	if reflect.DeepEqual([]interface{}{&Reply{1}}, ifaces) {
+	//The reply has to come back as it was sent
+	if !reflect.DeepEqual([]interface{}{&Reply{1}}, ifaces) {
 		t.Error("Something is not the same")
 	}
 }
@@ -263,3 +313,261 @@ func TestRPC(t *testing.T) {
 		t.Fatal("Different expected error. Got", err)
 	}
 }
+
+func TestInvoke(t *testing.T) {
+	_, addr := startAcceptServer(t, new(ResultService))
+	client, err := Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("dialing", err)
+	}
+	defer client.Close()
+	client.RegisterType(Reply{})
+	results, err := client.Invoke("ResultService.Divide", Args{7, 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(results, []interface{}{Reply{3}}) {
+		t.Errorf("Unexpected results %#v", results)
+	}
+	if _, err = client.Invoke("ResultService.Divide", Args{7, 0}); err == nil || err.Error() != "Division by zero" {
+		t.Error("Expected the error of the method and got", err)
+	}
+	//Pointer arguments are still filled before the results
+	rep := &Reply{}
+	results, err = client.Invoke("ResultService.DivMod", Args{7, 2}, rep)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rep.Num != 3 || !reflect.DeepEqual(results, []interface{}{1, "remainder"}) {
+		t.Errorf("Unexpected reply %v and results %#v", rep, results)
+	}
+	results, err = client.Invoke("ResultService.Find", Args{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(results, []interface{}{nil}) {
+		t.Errorf("Unexpected results %#v", results)
+	}
+	//Call ignores the results
+	if err = client.Call("ResultService.Divide", Args{7, 2}); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestPush(t *testing.T) {
+	srv, addr := startAcceptServer(t, new(PushService))
+	client, err := Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("dialing", err)
+	}
+	defer client.Close()
+	received := make(chan PushData, 2)
+	if err := client.SubscribeToPush(func(pd PushData) { received <- pd }); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Call("PushService.PushMe", Args{1, 2}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case pd := <-received:
+		if pd.A != 1 || pd.B != 2 {
+			t.Error("Pushed data differs", pd)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Did not receive push from Context")
+	}
+	ci := new(ClientInfo)
+	if err := client.Call("PushService.WhoAmI", ci); err != nil {
+		t.Fatal(err)
+	}
+	id := ci.Id
+	if err := srv.Push(id, &PushData{3, 4}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case pd := <-received:
+		if pd.A != 3 || pd.B != 4 {
+			t.Error("Pushed data differs", pd)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Did not receive push from Server")
+	}
+	if err := srv.Push(id+1000, PushData{}); err == nil {
+		t.Error("Pushing to an unknown client should fail")
+	}
+}
+
+func TestPublish(t *testing.T) {
+	srv, addr := startAcceptServer(t)
+	received := make([]chan PushData, 2)
+	for iPos, topic := range []string{"a", "b"} {
+		client, err := Dial("tcp", addr)
+		if err != nil {
+			t.Fatal("dialing", err)
+		}
+		defer client.Close()
+		ch := make(chan PushData, 2)
+		received[iPos] = ch
+		if err := client.SubscribeToTopic(topic, func(pd PushData) { ch <- pd }); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if sent, err := srv.Publish("a", PushData{1, 1}); err != nil || sent != 1 {
+		t.Fatal("Publish failed", sent, err)
+	}
+	if sent, err := srv.Publish("b", PushData{2, 2}); err != nil || sent != 1 {
+		t.Fatal("Publish failed", sent, err)
+	}
+	for iPos, ch := range received {
+		select {
+		case pd := <-ch:
+			if pd.A != uint(iPos+1) {
+				t.Error("Received data from the wrong topic", pd)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("Did not receive published data")
+		}
+	}
+	if sent, _ := srv.Publish("c", PushData{}); sent != 0 {
+		t.Error("Published to a topic without subscribers")
+	}
+}
+
+type MetaService struct {
+	release chan bool
+}
+
+func (ms *MetaService) Login(ctx *Context, a Args) error {
+	ctx.SetValue("user", a.A)
+	return nil
+}
+
+func (ms *MetaService) Wait(ctx *Context, a Args) error {
+	<-ms.release
+	return nil
+}
+
+func TestConnections(t *testing.T) {
+	ms := &MetaService{make(chan bool)}
+	srv, addr := startAcceptServer(t, ms)
+	client, err := Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("dialing", err)
+	}
+	defer client.Close()
+	if err := client.Call("MetaService.Login", Args{7, 0}); err != nil {
+		t.Fatal(err)
+	}
+	waitCall := client.Go(nil, "MetaService.Wait", Args{})
+	var infos []ConnectionInfo
+	for i := 0; i < 100; i++ {
+		infos = srv.Connections()
+		if len(infos) == 1 && infos[0].InFlight == 1 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(infos) != 1 {
+		t.Fatal("Expected one connection and got", len(infos))
+	}
+	info := infos[0]
+	if info.InFlight != 1 {
+		t.Error("Expected one call in flight and got", info.InFlight)
+	}
+	if info.BytesIn == 0 || info.BytesOut == 0 {
+		t.Error("Bytes were not counted")
+	}
+	if info.Metadata["user"] != 7 {
+		t.Error("Metadata does not contain the user value")
+	}
+	if info.RemoteAddr == nil || info.ConnectedAt.IsZero() {
+		t.Error("Connection info is incomplete")
+	}
+
+	if err := srv.Disconnect(info.ClientId, "go away"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case call := <-waitCall.Done:
+		if call.Error == nil || call.Error.Error() != "Disconnected by server: go away" {
+			t.Error("Unexpected error for pending call", call.Error)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Pending call did not fail after disconnect")
+	}
+	close(ms.release)
+	for i := 0; i < 100 && len(srv.Connections()) > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if len(srv.Connections()) != 0 {
+		t.Error("Connection was not removed")
+	}
+	if err := srv.Disconnect(info.ClientId, ""); err == nil {
+		t.Error("Disconnecting an unknown client should fail")
+	}
+}
+
+type ClientService struct{}
+
+func (cs *ClientService) Mul(ctx *Context, a Args, r *Reply) error {
+	r.Num = a.A * a.B
+	return nil
+}
+
+type ReverseService struct{}
+
+func (rs *ReverseService) Ask(ctx *Context, a Args, r *Reply) error {
+	return ctx.CallClient("ClientService.Mul", a, r)
+}
+
+func (rs *ReverseService) AskMissing(ctx *Context, a Args, r *Reply) error {
+	return ctx.CallClient("ClientService.Missing", a, r)
+}
+
+func TestCallClient(t *testing.T) {
+	_, addr := startAcceptServer(t, new(ReverseService))
+	client, err := Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("dialing", err)
+	}
+	defer client.Close()
+	if err := client.Register(new(ClientService)); err != nil {
+		t.Fatal(err)
+	}
+	rep := new(Reply)
+	if err := client.Call("ReverseService.Ask", Args{3, 4}, rep); err != nil {
+		t.Fatal(err)
+	}
+	if rep.Num != 12 {
+		t.Error("Reply from client does not match", rep.Num)
+	}
+	err = client.Call("ReverseService.AskMissing", Args{3, 4}, rep)
+	if err == nil || err.Error() != "Can't find method Missing for service ClientService" {
+		t.Error("Expected missing method error and got", err)
+	}
+}
+
+func TestSubscribeToDisconnect(t *testing.T) {
+	srv, addr := startAcceptServer(t, new(PushService))
+	client, err := Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("dialing", err)
+	}
+	disconnected := make(chan *Client, 1)
+	if err := client.SubscribeToDisconnect(func(c *Client) { disconnected <- c }); err != nil {
+		t.Fatal(err)
+	}
+	ci := new(ClientInfo)
+	if err := client.Call("PushService.WhoAmI", ci); err != nil {
+		t.Fatal(err)
+	}
+	srv.Disconnect(ci.Id, "bye")
+	select {
+	case c := <-disconnected:
+		if c != client {
+			t.Error("Received a different client")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Disconnect callback was not called")
+	}
+}
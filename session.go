@@ -0,0 +1,238 @@
+package clacks
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// SessionInfo is sent back to a client that asks to resume a session
+type SessionInfo struct {
+	Token   string // token to present on the next reconnection
+	Resumed bool   // false if a new session was started instead
+}
+
+type bufferedPush struct {
+	topic string
+	value interface{}
+}
+
+// session outlives connections so that a client can resume it
+type session struct {
+	token    string
+	clientId uint64
+	conn     *connection // nil while the client is away
+	values   map[interface{}]interface{}
+	topics   []string
+	pushes   []bufferedPush
+	expiry   *time.Timer
+}
+
+// sessionMap keeps the sessions of a server
+type sessionMap struct {
+	lock      sync.Mutex // protects following
+	byToken   map[string]*session
+	byClient  map[uint64]*session
+	window    time.Duration // time a detached session is kept
+	maxPushes int           // pushes buffered per detached session. 0 is unlimited
+}
+
+func newSessionToken() string {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		panic("clacks: cannot generate session token: " + err.Error())
+	}
+	return hex.EncodeToString(token)
+}
+
+//Create a session for a new connection
+func (sm *sessionMap) create(conn *connection) *session {
+	sess := &session{token: newSessionToken(), clientId: conn.id, conn: conn}
+	sm.lock.Lock()
+	defer sm.lock.Unlock()
+	if sm.byToken == nil {
+		sm.byToken = make(map[string]*session)
+		sm.byClient = make(map[uint64]*session)
+	}
+	sm.byToken[sess.token] = sess
+	sm.byClient[sess.clientId] = sess
+	return sess
+}
+
+func (sm *sessionMap) remove(sess *session) {
+	delete(sm.byToken, sess.token)
+	if sm.byClient[sess.clientId] == sess {
+		delete(sm.byClient, sess.clientId)
+	}
+}
+
+//The connection of a session is gone. Keep it for the window if there is one
+func (sm *sessionMap) detach(sess *session, conn *connection, values map[interface{}]interface{}, topics []string) {
+	sm.lock.Lock()
+	defer sm.lock.Unlock()
+	if sess.conn != conn {
+		return
+	}
+	sess.conn = nil
+	if sm.window <= 0 {
+		sm.remove(sess)
+		return
+	}
+	sess.values = values
+	sess.topics = topics
+	sess.expiry = time.AfterFunc(sm.window, func() {
+		sm.lock.Lock()
+		defer sm.lock.Unlock()
+		if sess.conn == nil {
+			sm.remove(sess)
+			sess.pushes = nil
+		}
+	})
+}
+
+//Attach a detached session to a new connection replacing the one it has
+func (sm *sessionMap) attach(token string, conn *connection, current *session) (*session, error) {
+	sm.lock.Lock()
+	defer sm.lock.Unlock()
+	sess, present := sm.byToken[token]
+	switch {
+	case !present:
+		return nil, errors.New("Unknown or expired session")
+	case sess.conn != nil:
+		return nil, errors.New("Session is in use by another connection")
+	}
+	sess.expiry.Stop()
+	sess.conn = conn
+	sm.remove(current)
+	sm.byClient[sess.clientId] = sess
+	return sess, nil
+}
+
+//Buffer a push for a client that is away. Returns false if there is no session
+func (sm *sessionMap) buffer(clientId uint64, value interface{}) bool {
+	sm.lock.Lock()
+	defer sm.lock.Unlock()
+	sess, present := sm.byClient[clientId]
+	if !present || sess.conn != nil {
+		return false
+	}
+	sm.addPush(sess, bufferedPush{"", value})
+	return true
+}
+
+//Buffer a published value for all the clients away subscribed to the topic
+func (sm *sessionMap) bufferTopic(topic string, value interface{}) {
+	sm.lock.Lock()
+	defer sm.lock.Unlock()
+	for _, sess := range sm.byToken {
+		if sess.conn != nil {
+			continue
+		}
+		for _, sTopic := range sess.topics {
+			if sTopic == topic {
+				sm.addPush(sess, bufferedPush{topic, value})
+				break
+			}
+		}
+	}
+}
+
+//Add a push dropping the oldest one if the buffer is full
+func (sm *sessionMap) addPush(sess *session, push bufferedPush) {
+	if sm.maxPushes > 0 && len(sess.pushes) >= sm.maxPushes {
+		copy(sess.pushes, sess.pushes[1:])
+		sess.pushes = sess.pushes[:len(sess.pushes)-1]
+	}
+	sess.pushes = append(sess.pushes, push)
+}
+
+//Take the pushes buffered while the client was away
+func (sm *sessionMap) takePushes(sess *session) []bufferedPush {
+	sm.lock.Lock()
+	defer sm.lock.Unlock()
+	pushes := sess.pushes
+	sess.pushes = nil
+	return pushes
+}
+
+// SetSessionWindow sets for how long the session of a disconnected client is
+// kept so that it can be resumed, and how many pushes are buffered for it
+// meanwhile. Once full the oldest pushes are dropped. A maxPushes of 0 means
+// no limit. A window of 0, the default, disables resuming sessions.
+func (server *Server) SetSessionWindow(window time.Duration, maxPushes int) {
+	server.sessions.lock.Lock()
+	defer server.sessions.lock.Unlock()
+	server.sessions.window = window
+	server.sessions.maxPushes = maxPushes
+}
+
+//Resume the session of a previous connection. It has to be the first request
+func (server *Server) processResume(conn *connection, req *Request) error {
+	ifaces := make([]interface{}, 0)
+	if err := conn.codec.ReadBody(&ifaces); err != nil {
+		return err
+	}
+	if conn.used {
+		server.sendResponse(req, conn.codec, "A session can only be resumed before any call", nil)
+		return nil
+	}
+	current := conn.ctx.getSession()
+	info := &SessionInfo{Token: current.token}
+	token := ""
+	if len(ifaces) > 0 {
+		token, _ = indirectValue(ifaces[0]).(string)
+	}
+	if token != "" {
+		if sess, err := server.sessions.attach(token, conn, current); err == nil {
+			server.lock.Lock()
+			delete(server.conns, conn.id)
+			conn.id = sess.clientId
+			server.conns[conn.id] = conn
+			server.lock.Unlock()
+			conn.ctx.setClientId(sess.clientId)
+			conn.ctx.setSession(sess)
+			for key, value := range sess.values {
+				conn.ctx.SetValue(key, value)
+			}
+			for _, topic := range sess.topics {
+				server.topics.subscribe(topic, conn)
+			}
+			info.Token = sess.token
+			info.Resumed = true
+			current = sess
+		}
+	}
+	err := server.sendResponse(req, conn.codec, "", []reflect.Value{reflect.ValueOf(info)})
+	if err != nil {
+		return err
+	}
+	for _, push := range server.sessions.takePushes(current) {
+		if err = conn.push(push.topic, push.value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Resume asks the server to resume the session identified by token. It has
+// to be called before any other call. If the session can not be resumed a
+// new one is started. In both cases the token to use next time is returned.
+func (client *Client) Resume(token string) (*SessionInfo, error) {
+	info := new(SessionInfo)
+	client.RegisterType(info)
+	call := &Call{Method: "", Args: []interface{}{token, info}, Done: make(chan *Call, 1), reqType: R_RESUME}
+	client.send(call)
+	<-call.Done
+	return info, call.Error
+}
+
+//Get the token that identifies the session of the client
+func (me *Context) GetSessionToken() string {
+	if sess := me.getSession(); sess != nil {
+		return sess.token
+	}
+	return ""
+}
@@ -0,0 +1,111 @@
+package clacks
+
+import (
+	"testing"
+	"time"
+)
+
+type SessionService struct{}
+
+func (ss *SessionService) Login(ctx *Context, a Args, ci *ClientInfo) error {
+	ctx.SetValue("user", a.A)
+	ci.Id = ctx.GetClientId()
+	return nil
+}
+
+func (ss *SessionService) User(ctx *Context, r *Reply) error {
+	r.Num, _ = ctx.GetValue("user").(int)
+	return nil
+}
+
+func TestResume(t *testing.T) {
+	srv, addr := startAcceptServer(t, new(SessionService))
+	srv.SetSessionWindow(time.Minute, 2)
+	client, err := Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("dialing", err)
+	}
+	info, err := client.Resume("")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Resumed || info.Token == "" {
+		t.Fatal("Expected a new session and got", info)
+	}
+	ci := new(ClientInfo)
+	if err := client.Call("SessionService.Login", Args{42, 0}, ci); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Resume(info.Token); err == nil {
+		t.Error("Resumed a session after a call")
+	}
+	if _, err := srv.Publish("none", PushData{}); err != nil {
+		t.Fatal(err)
+	}
+	client.Close()
+	for i := 0; i < 100 && len(srv.Connections()) > 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	//The first push is dropped because only two are kept
+	for i := 1; i <= 3; i++ {
+		if err := srv.Push(ci.Id, PushData{uint(i), 0}); err != nil {
+			t.Fatal("Push to a client away was not buffered", err)
+		}
+	}
+
+	client, err = Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("dialing", err)
+	}
+	defer client.Close()
+	received := make(chan PushData, 3)
+	if err := client.SubscribeToPush(func(pd PushData) { received <- pd }); err != nil {
+		t.Fatal(err)
+	}
+	resumed, err := client.Resume(info.Token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !resumed.Resumed || resumed.Token != info.Token {
+		t.Fatal("Session was not resumed", resumed)
+	}
+	rep := new(Reply)
+	if err := client.Call("SessionService.User", rep); err != nil {
+		t.Fatal(err)
+	}
+	if rep.Num != 42 {
+		t.Error("Context values were not kept", rep.Num)
+	}
+	got := map[uint]bool{}
+	for i := 0; i < 2; i++ {
+		select {
+		case pd := <-received:
+			got[pd.A] = true
+		case <-time.After(time.Second):
+			t.Fatal("Buffered pushes were not replayed")
+		}
+	}
+	if !got[2] || !got[3] {
+		t.Error("Unexpected pushes replayed", got)
+	}
+	infos := srv.Connections()
+	if len(infos) != 1 || infos[0].ClientId != ci.Id {
+		t.Error("Resumed connection does not keep the client id", infos)
+	}
+}
+
+func TestResumeUnknown(t *testing.T) {
+	_, addr := startAcceptServer(t)
+	client, err := Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("dialing", err)
+	}
+	defer client.Close()
+	info, err := client.Resume("nope")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Resumed || info.Token == "" || info.Token == "nope" {
+		t.Error("Expected a new session and got", info)
+	}
+}
@@ -0,0 +1,246 @@
+package clacks
+
+import (
+	"errors"
+	"io"
+	"reflect"
+	"strconv"
+	"sync"
+)
+
+// Stream is received by methods that send several values to the client
+// before returning. Methods receive it as their last argument.
+type Stream struct {
+	server *Server
+	codec  Codec
+	seq    uint64
+}
+
+//Send a value to the client as part of the stream
+func (stream *Stream) Send(value interface{}) error {
+	data, err := pushBody(value)
+	if err != nil {
+		return err
+	}
+	resp := stream.server.getResponse()
+	defer stream.server.freeResponse(resp)
+	resp.Type = R_DATA
+	resp.Seq = stream.seq
+	return stream.codec.WriteResponse(resp, data)
+}
+
+// DefaultStreamBuffer is how many received values a *RecvStream keeps until
+// the method reads them
+const DefaultStreamBuffer = 1024
+
+// valueQueue is a queue of received values so that the reading goroutine of
+// a connection never blocks on a slow consumer. Once it holds limit values
+// it fails with a ProtocolError instead of growing. A limit of 0 does not
+// bound it
+type valueQueue struct {
+	lock     sync.Mutex
+	cond     *sync.Cond
+	values   []interface{}
+	limit    int
+	finished bool
+	err      error
+}
+
+func (vq *valueQueue) init() {
+	vq.cond = sync.NewCond(&vq.lock)
+}
+
+//Add a value. Values that arrive once the queue is finished are dropped
+func (vq *valueQueue) add(value interface{}) {
+	vq.lock.Lock()
+	switch {
+	case vq.finished:
+	case vq.limit > 0 && len(vq.values) >= vq.limit:
+		vq.finished = true
+		vq.err = ProtocolError("Stream has more than " + strconv.Itoa(vq.limit) + " values waiting to be received")
+		vq.values = nil
+	default:
+		vq.values = append(vq.values, value)
+	}
+	vq.lock.Unlock()
+	vq.cond.Signal()
+}
+
+//No more values will be added. Once the queue is empty next returns err
+func (vq *valueQueue) finish(err error) {
+	vq.lock.Lock()
+	if !vq.finished {
+		vq.finished = true
+		vq.err = err
+	}
+	vq.lock.Unlock()
+	vq.cond.Broadcast()
+}
+
+func (vq *valueQueue) next() (interface{}, error) {
+	vq.lock.Lock()
+	defer vq.lock.Unlock()
+	for len(vq.values) == 0 && !vq.finished {
+		vq.cond.Wait()
+	}
+	if len(vq.values) > 0 {
+		value := vq.values[0]
+		vq.values[0] = nil
+		vq.values = vq.values[1:]
+		return value, nil
+	}
+	return nil, vq.err
+}
+
+// ClientStream receives the values sent by a streaming method
+type ClientStream struct {
+	call *Call
+	valueQueue
+}
+
+func newClientStream(call *Call) *ClientStream {
+	cs := &ClientStream{call: call}
+	cs.init()
+	call.stream = cs
+	go func() {
+		<-call.Done
+		if call.Error != nil {
+			cs.finish(call.Error)
+		} else {
+			cs.finish(io.EOF)
+		}
+	}()
+	return cs
+}
+
+// Recv returns the next value sent by the server. Once the method has
+// finished it returns io.EOF or the error returned by the method.
+func (cs *ClientStream) Recv() (interface{}, error) {
+	return cs.next()
+}
+
+//Get the call that started the stream. Pointer arguments are filled once
+//Recv has returned io.EOF.
+func (cs *ClientStream) Call() *Call {
+	return cs.call
+}
+
+//Read a R_DATA response and add it to the stream it belongs to
+func (client *Client) processDataResponse(response Response) error {
+	var data interface{}
+	if err := client.codec.ReadBody(&data); err != nil {
+		return err
+	}
+	client.mutex.Lock()
+	call := client.pending[response.Seq]
+	client.mutex.Unlock()
+	if call == nil || call.stream == nil {
+		//The call is already gone. Nobody is waiting for this data
+		return nil
+	}
+	call.stream.add(indirectValue(data))
+	return nil
+}
+
+//Remove all the pointer levels from a received value
+func indirectValue(data interface{}) interface{} {
+	value := reflect.ValueOf(data)
+	for value.Kind() == reflect.Ptr && !value.IsNil() {
+		value = value.Elem()
+	}
+	if !value.IsValid() {
+		return nil
+	}
+	return value.Interface()
+}
+
+// RecvStream is received by methods that read several values sent by the
+// client. Methods receive it as their last argument.
+type RecvStream struct {
+	valueQueue
+}
+
+func newRecvStream(limit int) *RecvStream {
+	rs := &RecvStream{valueQueue{limit: limit}}
+	rs.init()
+	return rs
+}
+
+// Recv returns the next value sent by the client. It returns io.EOF once
+// the client has closed the stream, or a ProtocolError if the client sent
+// more values than the server buffers before the method read them.
+func (rs *RecvStream) Recv() (interface{}, error) {
+	return rs.next()
+}
+
+// SetStreamBuffer sets how many values sent by a client to a *RecvStream the
+// server keeps until the method reads them. The stream fails with a
+// ProtocolError when a client sends more. A size of 0 does not limit them.
+// Applies to calls made afterwards.
+func (server *Server) SetStreamBuffer(size int) {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	server.streamBuffer = size
+}
+
+// UploadStream sends values to a method that receives a *RecvStream
+type UploadStream struct {
+	client *Client
+	call   *Call
+}
+
+//Send a value to the method
+func (us *UploadStream) Send(value interface{}) error {
+	if err := us.check(); err != nil {
+		return err
+	}
+	data, err := pushBody(value)
+	if err != nil {
+		return err
+	}
+	return us.client.codec.WriteRequest(&Request{Type: R_DATA, Seq: us.call.seq}, data)
+}
+
+//Tell the method that there are no more values and wait for its reply.
+//Pointer arguments are filled with the values sent back.
+func (us *UploadStream) CloseAndRecv() error {
+	if err := us.check(); err == nil {
+		if err = us.client.codec.WriteRequest(&Request{Type: R_END, Seq: us.call.seq}, nil); err != nil {
+			return err
+		}
+	}
+	<-us.call.Done
+	return us.call.Error
+}
+
+//Check that the call is still waiting for values
+func (us *UploadStream) check() error {
+	us.client.mutex.Lock()
+	defer us.client.mutex.Unlock()
+	if us.client.pending[us.call.seq] != us.call {
+		if us.call.Error != nil {
+			return us.call.Error
+		}
+		return errors.New("Stream is already closed")
+	}
+	return nil
+}
+
+//Read a R_DATA request and add it to the stream it belongs to
+func (conn *connection) processData(req *Request) error {
+	var data interface{}
+	if err := conn.codec.ReadBody(&data); err != nil {
+		return err
+	}
+	if stream := conn.getStream(req.Seq); stream != nil {
+		stream.add(indirectValue(data))
+	}
+	return nil
+}
+
+//Process the end of a stream sent by the client
+func (conn *connection) processEnd(req *Request) {
+	if stream := conn.getStream(req.Seq); stream != nil {
+		stream.finish(io.EOF)
+	}
+}
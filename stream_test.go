@@ -0,0 +1,182 @@
+package clacks
+
+import (
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+type StreamService struct{}
+
+func (ss *StreamService) Count(ctx *Context, a Args, r *Reply, stream *Stream) error {
+	for i := 0; i < a.A; i++ {
+		if err := stream.Send(PushData{uint(i), uint(a.B)}); err != nil {
+			return err
+		}
+	}
+	r.Num = a.A
+	return nil
+}
+
+func (ss *StreamService) Fail(ctx *Context, stream *Stream) error {
+	stream.Send(PushData{1, 1})
+	return errors.New("Stream failed")
+}
+
+type InvalidStreamService struct{}
+
+func (ss *InvalidStreamService) Func1(ctx *Context, stream *Stream, a Args) error {
+	return nil
+}
+
+func TestStreamArguments(t *testing.T) {
+	registry := new(Registry)
+	if err := registry.Register(new(StreamService)); err != nil {
+		t.Fatal(err)
+	}
+	_, mData := registry.GetServiceMethod("StreamService", "Count")
+	if !mData.stream {
+		t.Error("Method was not detected as streaming")
+	}
+	if len(mData.args) != 2 || mData.numPointers != 1 {
+		t.Error("Stream should not be counted as an argument")
+	}
+	if err := registry.Register(new(InvalidStreamService)); err == nil {
+		t.Error("Allowed a *Stream that is not the last argument")
+	}
+}
+
+func TestStream(t *testing.T) {
+	_, addr := startAcceptServer(t, new(StreamService))
+	client, err := Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("dialing", err)
+	}
+	defer client.Close()
+	client.RegisterType(PushData{})
+	rep := new(Reply)
+	stream := client.Stream("StreamService.Count", Args{5, 9}, rep)
+	received := make([]interface{}, 0)
+	for {
+		value, err := stream.Recv()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		received = append(received, value)
+	}
+	expected := make([]interface{}, 5)
+	for i := range expected {
+		expected[i] = PushData{uint(i), 9}
+	}
+	if !reflect.DeepEqual(received, expected) {
+		t.Error("Received values differ", received)
+	}
+	if rep.Num != 5 {
+		t.Error("Reply was not filled after the stream ended")
+	}
+
+	stream = client.Stream("StreamService.Fail")
+	if value, err := stream.Recv(); err != nil || value != (PushData{1, 1}) {
+		t.Error("Did not receive the value sent before failing", value, err)
+	}
+	if _, err := stream.Recv(); err == nil || err.Error() != "Stream failed" {
+		t.Error("Expected the method error and got", err)
+	}
+}
+
+type UploadService struct {
+	release chan struct{}
+}
+
+func (us *UploadService) Sum(ctx *Context, a Args, r *Reply, stream *RecvStream) error {
+	r.Num = a.A
+	for {
+		value, err := stream.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		pd := value.(PushData)
+		r.Num += int(pd.A + pd.B)
+	}
+}
+
+//Read the values once the test lets it
+func (us *UploadService) Late(ctx *Context, stream *RecvStream) error {
+	<-us.release
+	for {
+		if _, err := stream.Recv(); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
+func (us *UploadService) Reject(ctx *Context, stream *RecvStream) error {
+	return errors.New("Rejected")
+}
+
+func TestUpload(t *testing.T) {
+	srv, addr := startAcceptServer(t, new(UploadService))
+	srv.Types().Register(PushData{})
+	client, err := Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("dialing", err)
+	}
+	defer client.Close()
+	rep := new(Reply)
+	stream := client.Upload("UploadService.Sum", Args{100, 0}, rep)
+	for i := 0; i < 10; i++ {
+		if err := stream.Send(PushData{uint(i), 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := stream.CloseAndRecv(); err != nil {
+		t.Fatal(err)
+	}
+	if rep.Num != 155 {
+		t.Error("Uploaded values were not received", rep.Num)
+	}
+	if err := stream.Send(PushData{}); err == nil {
+		t.Error("Could send values after closing the stream")
+	}
+
+	stream = client.Upload("UploadService.Reject")
+	if err := stream.CloseAndRecv(); err == nil || err.Error() != "Rejected" {
+		t.Error("Expected the method error and got", err)
+	}
+}
+
+func TestUploadLimit(t *testing.T) {
+	svc := &UploadService{release: make(chan struct{})}
+	srv, addr := startAcceptServer(t, svc)
+	srv.Types().Register(PushData{})
+	srv.SetStreamBuffer(2)
+	client, err := Dial("tcp", addr)
+	if err != nil {
+		t.Fatal("dialing", err)
+	}
+	defer client.Close()
+	stream := client.Upload("UploadService.Late")
+	for i := 0; i < 5; i++ {
+		if err := stream.Send(PushData{uint(i), 1}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	//Let the server read the values before the method does
+	time.Sleep(50 * time.Millisecond)
+	close(svc.release)
+	if err := stream.CloseAndRecv(); err == nil || !strings.Contains(err.Error(), "more than 2 values") {
+		t.Error("Expected the stream to fail and got", err)
+	}
+}
@@ -0,0 +1,89 @@
+package clacks
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+)
+
+// AcceptTLS accepts TLS connections on the listener and serves requests for
+// each of them. Set ClientAuth and ClientCAs in config to require and verify
+// client certificates, and read them in handlers with
+// Context.GetPeerCertificates.
+func (server *Server) AcceptTLS(lis net.Listener, config *tls.Config) {
+	server.Accept(tls.NewListener(lis, config))
+}
+
+//Get the TLS state of a connection looking through the ones that wrap it
+func tlsState(conn net.Conn) *tls.ConnectionState {
+	switch c := conn.(type) {
+	case *tls.Conn:
+		state := c.ConnectionState()
+		return &state
+	case *wsConn:
+		return tlsState(c.Conn)
+	case *countingConn:
+		return tlsState(c.Conn)
+	}
+	return nil
+}
+
+func (me *Context) setTLSState(state *tls.ConnectionState) {
+	me.withValue(tlsStateKey, state)
+}
+
+func (me *Context) getTLSState() *tls.ConnectionState {
+	state, _ := me.getCtx().Value(tlsStateKey).(*tls.ConnectionState)
+	return state
+}
+
+//Get the verified certificate chain of the peer, starting with its own
+//certificate. It is nil unless the connection uses TLS and the peer sent a
+//certificate that was verified
+func (me *Context) GetPeerCertificates() []*x509.Certificate {
+	state := me.getTLSState()
+	if state == nil || len(state.VerifiedChains) == 0 {
+		return nil
+	}
+	return state.VerifiedChains[0]
+}
+
+//Get the subject of the verified certificate of the peer, like
+//"CN=client,O=Example". It is empty if there is none
+func (me *Context) GetPeerSubject() string {
+	chain := me.GetPeerCertificates()
+	if len(chain) == 0 {
+		return ""
+	}
+	return chain[0].Subject.String()
+}
+
+// DialTLS connects to a server that accepts TLS connections, like the ones
+// served with AcceptTLS. Set Certificates in config to authenticate the
+// client.
+func DialTLS(network, address string, config *tls.Config) (*Client, error) {
+	conn, err := tls.Dial(network, address, config)
+	if err != nil {
+		return nil, err
+	}
+	return NewClientHandshake(conn, DefaultHandshake)
+}
+
+// DialHTTPPathTLS connects to an HTTPS RPC server at the specified network
+// address and path.
+func DialHTTPPathTLS(network, address, path string, config *tls.Config) (*Client, error) {
+	conn, err := dialHTTPPath(network, address, path, config)
+	if err != nil {
+		return nil, err
+	}
+	return NewClientHandshake(conn, DefaultHandshake)
+}
+
+// DialWebSocketTLS connects to the server at a wss:// URL with config.
+func DialWebSocketTLS(rawurl string, config *tls.Config) (*Client, error) {
+	conn, err := dialWebSocket(rawurl, config)
+	if err != nil {
+		return nil, err
+	}
+	return NewClientHandshake(conn, DefaultHandshake)
+}
@@ -0,0 +1,148 @@
+package clacks
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io"
+	"math/big"
+	"net"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type PeerService struct{}
+
+func (ps *PeerService) Subject(ctx *Context, subject *string) error {
+	*subject = ctx.GetPeerSubject()
+	return nil
+}
+
+//Create a certificate signed by parent, or self signed if parent is nil
+func newTestCert(t *testing.T, name string, parent *tls.Certificate) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+	}
+	signer, signerKey := template, interface{}(key)
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+	} else {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestTLS(t *testing.T) {
+	ca := newTestCert(t, "Test CA", nil)
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.Leaf)
+	serverConfig := &tls.Config{
+		Certificates: []tls.Certificate{newTestCert(t, "server", &ca)},
+		ClientAuth:   tls.VerifyClientCertIfGiven,
+		ClientCAs:    pool,
+	}
+	srv := NewServer()
+	srv.Register(new(PeerService))
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen tcp :0: %v", err)
+	}
+	go srv.AcceptTLS(l, serverConfig)
+
+	clientConfig := &tls.Config{RootCAs: pool, Certificates: []tls.Certificate{newTestCert(t, "alice", &ca)}}
+	client, err := DialTLS("tcp", l.Addr().String(), clientConfig)
+	if err != nil {
+		t.Fatal("dialing", err)
+	}
+	defer client.Close()
+	subject := ""
+	if err := client.Call("PeerService.Subject", &subject); err != nil || subject != "CN=alice" {
+		t.Error("Unexpected peer subject", subject, err)
+	}
+	if chain := client.ctx.GetPeerCertificates(); len(chain) != 2 || chain[0].Subject.CommonName != "server" {
+		t.Error("Client did not get the chain of the server", chain)
+	}
+
+	//Without a certificate there is no subject
+	anonymous, err := DialTLS("tcp", l.Addr().String(), &tls.Config{RootCAs: pool})
+	if err != nil {
+		t.Fatal("dialing", err)
+	}
+	defer anonymous.Close()
+	if err := anonymous.Call("PeerService.Subject", &subject); err != nil || subject != "" {
+		t.Error("Unexpected peer subject", subject, err)
+	}
+
+	//Certificates are verified over WebSocket too
+	httpSrv := httptest.NewUnstartedServer(srv)
+	httpSrv.TLS = serverConfig
+	httpSrv.StartTLS()
+	defer httpSrv.Close()
+	wsClient, err := DialWebSocketTLS("wss://"+httpSrv.Listener.Addr().String()+RPCPath, clientConfig)
+	if err != nil {
+		t.Fatal("dialing", err)
+	}
+	defer wsClient.Close()
+	if err := wsClient.Call("PeerService.Subject", &subject); err != nil || subject != "CN=alice" {
+		t.Error("Unexpected peer subject over WebSocket", subject, err)
+	}
+
+	required := serverConfig.Clone()
+	required.ClientAuth = tls.RequireAndVerifyClientCert
+	l, err = net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen tcp :0: %v", err)
+	}
+	go srv.AcceptTLS(l, required)
+	if anonymous, err := DialTLS("tcp", l.Addr().String(), &tls.Config{RootCAs: pool}); err == nil {
+		err = anonymous.Call("PeerService.Subject", &subject)
+		anonymous.Close()
+		if err == nil {
+			t.Error("Client without certificate was served")
+		}
+	}
+}
+
+func TestTLSHandshakeTimeout(t *testing.T) {
+	srv := NewServer()
+	srv.SetHandshakeTimeout(20 * time.Millisecond)
+	cert := newTestCert(t, "127.0.0.1", nil)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen tcp :0: %v", err)
+	}
+	go srv.AcceptTLS(l, &tls.Config{Certificates: []tls.Certificate{cert}})
+	//A client that never starts the TLS handshake
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal("dialing", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Error("Expected the server to close the connection and got", err)
+	}
+}
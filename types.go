@@ -0,0 +1,107 @@
+package clacks
+
+import (
+	"errors"
+	"reflect"
+	"sync"
+)
+
+// TypeTable maps the types of the values sent as interfaces, like pushes,
+// to the names they travel with. Each server and client has its own one and
+// their codecs use it to send and read those values. Types travel with the
+// package and name of the type unless they are registered with another name,
+// which allows renaming a package without breaking the peers. Types from
+// packages with the same name have to be registered with their own names.
+type TypeTable struct {
+	lock  sync.RWMutex
+	types map[string]reflect.Type
+	names map[reflect.Type]string
+}
+
+func NewTypeTable() *TypeTable {
+	tt := &TypeTable{types: make(map[string]reflect.Type), names: make(map[reflect.Type]string)}
+	for _, val := range []interface{}{
+		false, "", int(0), int8(0), int16(0), int32(0), int64(0),
+		uint(0), uint8(0), uint16(0), uint32(0), uint64(0),
+		float32(0), float64(0), []byte(nil), SessionInfo{},
+	} {
+		tt.Register(val)
+	}
+	return tt
+}
+
+//Pointers travel as the type they point to
+func baseType(typ reflect.Type) reflect.Type {
+	for typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	return typ
+}
+
+//Register the type of val with its default name. Types that already have a
+//name keep it. Fails if another type, from a package with the same name,
+//already uses the name. That type keeps it and values of this one travel
+//with the import path of their package until it gets a name of its own
+func (tt *TypeTable) Register(val interface{}) error {
+	typ := reflect.TypeOf(val)
+	if typ == nil {
+		return nil
+	}
+	typ = baseType(typ)
+	tt.lock.Lock()
+	defer tt.lock.Unlock()
+	if _, ok := tt.names[typ]; ok {
+		return nil
+	}
+	name := typ.String()
+	if other, used := tt.types[name]; used && other != typ {
+		return errors.New("Name " + name + " is already used by " + other.PkgPath() + "." + other.Name() + ". Use RegisterName")
+	}
+	tt.types[name] = typ
+	tt.names[typ] = name
+	return nil
+}
+
+//Register the type of val to travel as name. Both sides have to use the same
+//name. A name can not be used by two types
+func (tt *TypeTable) RegisterName(name string, val interface{}) error {
+	typ := reflect.TypeOf(val)
+	if typ == nil || name == "" {
+		return errors.New("A type and a name are required")
+	}
+	typ = baseType(typ)
+	tt.lock.Lock()
+	defer tt.lock.Unlock()
+	if other, used := tt.types[name]; used && other != typ {
+		return errors.New("Name " + name + " is already used by " + other.String())
+	}
+	if old, ok := tt.names[typ]; ok && tt.types[old] == typ {
+		delete(tt.types, old)
+	}
+	tt.types[name] = typ
+	tt.names[typ] = name
+	return nil
+}
+
+//Get the name a type travels with
+func (tt *TypeTable) nameOf(typ reflect.Type) string {
+	typ = baseType(typ)
+	tt.lock.RLock()
+	defer tt.lock.RUnlock()
+	if name, ok := tt.names[typ]; ok {
+		return name
+	}
+	//Never the name of another type, so that it is not read as that one
+	name := typ.String()
+	if other, used := tt.types[name]; used && other != typ {
+		return typ.PkgPath() + "." + typ.Name()
+	}
+	return name
+}
+
+func (tt *TypeTable) lookup(name string) (reflect.Type, bool) {
+	tt.lock.RLock()
+	defer tt.lock.RUnlock()
+	typ, ok := tt.types[name]
+	return typ, ok
+}
@@ -0,0 +1,100 @@
+package clacks
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// RenamedPushData stands for PushData after moving it to another package
+type RenamedPushData struct {
+	A uint
+	B uint
+}
+
+func TestTypeTable(t *testing.T) {
+	tt := NewTypeTable()
+	tt.Register(&BodyData{})
+	if name := tt.nameOf(reflect.TypeOf(BodyData{})); name != "clacks.BodyData" {
+		t.Error("Unexpected default name", name)
+	}
+	if err := tt.RegisterName("body", BodyData{}); err != nil {
+		t.Fatal(err)
+	}
+	tt.Register(BodyData{})
+	if name := tt.nameOf(reflect.TypeOf(&BodyData{})); name != "body" {
+		t.Error("Explicit name was not kept", name)
+	}
+	if _, ok := tt.lookup("clacks.BodyData"); ok {
+		t.Error("Default name is still registered")
+	}
+	if typ, ok := tt.lookup("body"); !ok || typ != reflect.TypeOf(BodyData{}) {
+		t.Error("Name does not resolve to the type", typ)
+	}
+	if err := tt.RegisterName("body", PushData{}); err == nil {
+		t.Error("Registered two types with the same name")
+	}
+	if _, ok := NewTypeTable().lookup("body"); ok {
+		t.Error("Tables share their names")
+	}
+}
+
+func TestTypeTableCollision(t *testing.T) {
+	tt := NewTypeTable()
+	if err := tt.Register(PushData{}); err != nil {
+		t.Fatal(err)
+	}
+	//Same name as the package level PushData, like a type from another
+	//package called clacks
+	type PushData struct{ C string }
+	if err := tt.Register(PushData{}); err == nil {
+		t.Error("Registered two types with the same default name")
+	}
+	name := tt.nameOf(reflect.TypeOf(PushData{}))
+	if typ, ok := tt.lookup(name); name == "clacks.PushData" || (ok && typ != reflect.TypeOf(PushData{})) {
+		t.Error("Colliding type travels as the other one", name)
+	}
+	if err := tt.RegisterName("other.PushData", PushData{}); err != nil {
+		t.Fatal(err)
+	}
+	if typ, _ := tt.lookup("other.PushData"); typ != reflect.TypeOf(PushData{}) {
+		t.Error("Colliding type can not be registered with its own name", typ)
+	}
+}
+
+func TestTypeTableNames(t *testing.T) {
+	srv, addr := startAcceptServer(t, new(PushService))
+	if err := srv.Types().RegisterName("push", PushData{}); err != nil {
+		t.Fatal(err)
+	}
+	for _, codec := range []string{"gob", "json", "msgpack"} {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal("dialing", err)
+		}
+		client, err := NewClientHandshake(conn, Handshake{Codecs: []string{codec}})
+		if err != nil {
+			t.Fatal(codec, err)
+		}
+		if err := client.Types().RegisterName("push", RenamedPushData{}); err != nil {
+			t.Fatal(err)
+		}
+		received := make(chan RenamedPushData, 1)
+		if err := client.SubscribeToPush(func(pd RenamedPushData) { received <- pd }); err != nil {
+			t.Fatal(err)
+		}
+		if err := client.Call("PushService.PushMe", Args{3, 4}); err != nil {
+			t.Fatal(codec, err)
+		}
+		select {
+		case pd := <-received:
+			if pd.A != 3 || pd.B != 4 {
+				t.Error(codec, "Pushed data differs", pd)
+			}
+		case <-time.After(time.Second):
+			t.Error(codec, "Push was not received with the renamed type")
+		}
+		client.Close()
+	}
+}
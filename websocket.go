@@ -0,0 +1,365 @@
+package clacks
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	webSocketGUID      = "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	wsOpContinuation   = 0x0
+	wsOpText           = 0x1
+	wsOpBinary         = 0x2
+	wsOpClose          = 0x8
+	wsOpPing           = 0x9
+	wsOpPong           = 0xA
+	wsFinal            = 0x80
+	wsMasked           = 0x80
+	wsMaxControlLength = 125
+	wsCloseNormal      = 1000
+	wsCloseProtocol    = 1002
+)
+
+// wsConn turns the messages of a WebSocket into a stream so that it can be
+// used like any other connection. Each write is sent as a binary message and
+// the payload of the messages received is read in order. Pings are answered
+// while reading.
+type wsConn struct {
+	net.Conn
+	reader    *bufio.Reader
+	client    bool // clients mask what they send and servers do not
+	remaining uint64
+	masked    bool
+	mask      [4]byte
+	maskPos   int
+	writeLock sync.Mutex // protects following
+	closed    bool
+}
+
+func newWebSocketConn(conn net.Conn, reader *bufio.Reader, client bool) *wsConn {
+	return &wsConn{Conn: conn, reader: reader, client: client}
+}
+
+//Get the value of Sec-WebSocket-Accept for a key
+func webSocketAccept(key string) string {
+	hash := sha1.Sum([]byte(key + webSocketGUID))
+	return base64.StdEncoding.EncodeToString(hash[:])
+}
+
+//Check if a header has a token in its comma separated list
+func headerHasToken(header http.Header, name, token string) bool {
+	for _, value := range header[http.CanonicalHeaderKey(name)] {
+		for _, part := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(part), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (ws *wsConn) writeFrame(opcode byte, payload []byte) error {
+	ws.writeLock.Lock()
+	defer ws.writeLock.Unlock()
+	if ws.closed {
+		return io.ErrClosedPipe
+	}
+	frame := make([]byte, 2, 14+len(payload))
+	frame[0] = wsFinal | opcode
+	switch size := len(payload); {
+	case size <= wsMaxControlLength:
+		frame[1] = byte(size)
+	case size <= 0xFFFF:
+		frame[1] = 126
+		frame = binary.BigEndian.AppendUint16(frame, uint16(size))
+	default:
+		frame[1] = 127
+		frame = binary.BigEndian.AppendUint64(frame, uint64(size))
+	}
+	if !ws.client {
+		frame = append(frame, payload...)
+	} else {
+		var mask [4]byte
+		if _, err := rand.Read(mask[:]); err != nil {
+			return err
+		}
+		frame[1] |= wsMasked
+		frame = append(frame, mask[:]...)
+		for iPos, b := range payload {
+			frame = append(frame, b^mask[iPos%4])
+		}
+	}
+	_, err := ws.Conn.Write(frame)
+	return err
+}
+
+func (ws *wsConn) Write(data []byte) (int, error) {
+	if err := ws.writeFrame(wsOpBinary, data); err != nil {
+		return 0, err
+	}
+	return len(data), nil
+}
+
+//Send a close frame with a status and close the connection
+func (ws *wsConn) closeWith(status uint16, reason string) error {
+	payload := binary.BigEndian.AppendUint16(nil, status)
+	if len(reason) > wsMaxControlLength-2 {
+		reason = reason[:wsMaxControlLength-2]
+	}
+	ws.writeFrame(wsOpClose, append(payload, reason...))
+	ws.writeLock.Lock()
+	defer ws.writeLock.Unlock()
+	if ws.closed {
+		return nil
+	}
+	ws.closed = true
+	return ws.Conn.Close()
+}
+
+func (ws *wsConn) Close() error {
+	return ws.closeWith(wsCloseNormal, "")
+}
+
+//Fail the connection when the peer breaks RFC 6455
+func (ws *wsConn) protocolError(reason string) error {
+	ws.closeWith(wsCloseProtocol, reason)
+	return ProtocolError("WebSocket: " + reason)
+}
+
+//Read frame headers until a data frame with payload arrives, answering the
+//control frames found on the way
+func (ws *wsConn) nextFrame() error {
+	for {
+		var header [2]byte
+		if _, err := io.ReadFull(ws.reader, header[:]); err != nil {
+			return err
+		}
+		opcode := header[0] & 0x0F
+		if header[0]&0x70 != 0 {
+			return ws.protocolError("Reserved bits are set")
+		}
+		ws.masked = header[1]&wsMasked != 0
+		if ws.masked == ws.client {
+			return ws.protocolError("Unexpected masking of frames")
+		}
+		size := uint64(header[1] & 0x7F)
+		switch size {
+		case 126:
+			var ext [2]byte
+			if _, err := io.ReadFull(ws.reader, ext[:]); err != nil {
+				return unexpectedEOF(err)
+			}
+			size = uint64(binary.BigEndian.Uint16(ext[:]))
+		case 127:
+			var ext [8]byte
+			if _, err := io.ReadFull(ws.reader, ext[:]); err != nil {
+				return unexpectedEOF(err)
+			}
+			size = binary.BigEndian.Uint64(ext[:])
+		}
+		if ws.masked {
+			if _, err := io.ReadFull(ws.reader, ws.mask[:]); err != nil {
+				return unexpectedEOF(err)
+			}
+		}
+		ws.maskPos = 0
+		switch opcode {
+		case wsOpContinuation, wsOpText, wsOpBinary:
+			if size > 0 {
+				ws.remaining = size
+				return nil
+			}
+			continue
+		case wsOpClose, wsOpPing, wsOpPong:
+		default:
+			return ws.protocolError("Unknown opcode " + strconv.Itoa(int(opcode)))
+		}
+		if size > wsMaxControlLength || header[0]&wsFinal == 0 {
+			return ws.protocolError("Invalid control frame")
+		}
+		payload := make([]byte, size)
+		if _, err := io.ReadFull(ws.reader, payload); err != nil {
+			return unexpectedEOF(err)
+		}
+		ws.unmask(payload)
+		switch opcode {
+		case wsOpPing:
+			if err := ws.writeFrame(wsOpPong, payload); err != nil {
+				return err
+			}
+		case wsOpClose:
+			status := uint16(wsCloseNormal)
+			if len(payload) >= 2 {
+				status = binary.BigEndian.Uint16(payload)
+			}
+			ws.closeWith(status, "")
+			return io.EOF
+		}
+	}
+}
+
+func (ws *wsConn) unmask(data []byte) {
+	if !ws.masked {
+		return
+	}
+	for iPos := range data {
+		data[iPos] ^= ws.mask[ws.maskPos%4]
+		ws.maskPos++
+	}
+}
+
+func (ws *wsConn) Read(data []byte) (int, error) {
+	if ws.remaining == 0 {
+		if err := ws.nextFrame(); err != nil {
+			return 0, err
+		}
+	}
+	if uint64(len(data)) > ws.remaining {
+		data = data[:ws.remaining]
+	}
+	n, err := ws.reader.Read(data)
+	ws.unmask(data[:n])
+	ws.remaining -= uint64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+// SetOriginCheck sets the function that decides whether a WebSocket request
+// coming from the page in its Origin header is accepted. Rejected requests
+// get a 403 Forbidden. A nil check restores the default, which accepts
+// requests without an Origin, like the ones of DialWebSocket, and the ones
+// from pages served by the same host.
+func (server *Server) SetOriginCheck(check func(req *http.Request) bool) {
+	server.lock.Lock()
+	defer server.lock.Unlock()
+	server.originCheck = check
+}
+
+//Accept requests that are not made by a browser or come from the same host
+func sameOrigin(req *http.Request) bool {
+	origin := req.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, req.Host)
+}
+
+//Upgrade the request to a WebSocket and process it like any other connection
+func (server *Server) serveWebSocket(w http.ResponseWriter, req *http.Request) {
+	key := req.Header.Get("Sec-WebSocket-Key")
+	if req.Method != "GET" || !headerHasToken(req.Header, "Connection", "upgrade") || key == "" {
+		http.Error(w, "400 invalid WebSocket handshake", http.StatusBadRequest)
+		return
+	}
+	if req.Header.Get("Sec-WebSocket-Version") != "13" {
+		w.Header().Set("Sec-WebSocket-Version", "13")
+		http.Error(w, "426 unsupported WebSocket version", http.StatusUpgradeRequired)
+		return
+	}
+	server.lock.Lock()
+	originCheck := server.originCheck
+	server.lock.Unlock()
+	if originCheck == nil {
+		originCheck = sameOrigin
+	}
+	if !originCheck(req) {
+		http.Error(w, "403 WebSocket origin not allowed", http.StatusForbidden)
+		return
+	}
+	conn, bufrw, err := w.(http.Hijacker).Hijack()
+	if err != nil {
+		log.Print("rpc hijacking ", req.RemoteAddr, ": ", err.Error())
+		return
+	}
+	io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Sec-WebSocket-Accept: "+webSocketAccept(key)+"\r\n\r\n")
+	server.ProcessConnection(newWebSocketConn(conn, bufrw.Reader, false))
+}
+
+// DialWebSocket connects to the server at a ws:// or wss:// URL, like
+// ws://host:port/RPC for a server that serves HTTP with HandleHTTP.
+func DialWebSocket(rawurl string) (*Client, error) {
+	conn, err := dialWebSocket(rawurl, nil)
+	if err != nil {
+		return nil, err
+	}
+	return NewClientHandshake(conn, DefaultHandshake)
+}
+
+//Connect and upgrade to a WebSocket. wss:// URLs use config if it is set
+func dialWebSocket(rawurl string, config *tls.Config) (net.Conn, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	address := u.Host
+	var conn net.Conn
+	switch u.Scheme {
+	case "ws":
+		if u.Port() == "" {
+			address = net.JoinHostPort(u.Hostname(), "80")
+		}
+		conn, err = net.Dial("tcp", address)
+	case "wss":
+		if u.Port() == "" {
+			address = net.JoinHostPort(u.Hostname(), "443")
+		}
+		if config == nil {
+			config = &tls.Config{ServerName: u.Hostname()}
+		}
+		conn, err = tls.Dial("tcp", address, config)
+	default:
+		return nil, errors.New("Unsupported WebSocket scheme " + u.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var nonce [16]byte
+	if _, err = rand.Read(nonce[:]); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce[:])
+	io.WriteString(conn, "GET "+u.RequestURI()+" HTTP/1.1\r\n"+
+		"Host: "+u.Host+"\r\n"+
+		"Upgrade: websocket\r\n"+
+		"Connection: Upgrade\r\n"+
+		"Sec-WebSocket-Key: "+key+"\r\n"+
+		"Sec-WebSocket-Version: 13\r\n\r\n")
+
+	// Require the upgrade before switching to RPC protocol.
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, &http.Request{Method: "GET"})
+	if err == nil && resp.StatusCode == http.StatusSwitchingProtocols &&
+		resp.Header.Get("Sec-WebSocket-Accept") == webSocketAccept(key) {
+		return newWebSocketConn(conn, reader, true), nil
+	}
+	if err == nil {
+		err = errors.New("unexpected HTTP response: " + resp.Status)
+	}
+	conn.Close()
+	return nil, &net.OpError{
+		Op:   "dial-websocket",
+		Net:  "tcp " + address,
+		Addr: nil,
+		Err:  err,
+	}
+}
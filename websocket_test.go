@@ -0,0 +1,164 @@
+package clacks
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+type EchoService struct{}
+
+func (es *EchoService) Echo(ctx *Context, s string, r *string) error {
+	*r = s
+	return nil
+}
+
+func TestWebSocket(t *testing.T) {
+	srv := NewServer()
+	srv.Register(new(EchoService))
+	srv.Register(new(PushService))
+	httpSrv := httptest.NewServer(srv)
+	defer httpSrv.Close()
+	client, err := DialWebSocket("ws://" + httpSrv.Listener.Addr().String() + RPCPath)
+	if err != nil {
+		t.Fatal("dialing", err)
+	}
+	defer client.Close()
+	//Sizes that use each length encoding of the frames
+	for _, size := range []int{10, 1000, 100000} {
+		sent, reply := strings.Repeat("x", size), ""
+		if err := client.Call("EchoService.Echo", sent, &reply); err != nil || reply != sent {
+			t.Fatal("Echo of", size, "bytes failed", err)
+		}
+	}
+	received := make(chan PushData, 1)
+	if err := client.SubscribeToPush(func(pd PushData) { received <- pd }); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.Call("PushService.PushMe", Args{1, 2}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case pd := <-received:
+		if pd.A != 1 || pd.B != 2 {
+			t.Error("Pushed data differs", pd)
+		}
+	case <-time.After(time.Second):
+		t.Error("Push was not received")
+	}
+
+	resp, err := http.Get(httpSrv.URL + RPCPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Error("Plain GET got", resp.Status)
+	}
+	req, _ := http.NewRequest("GET", httpSrv.URL+RPCPath, nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Error("Upgrade without a key got", resp.Status)
+	}
+}
+
+//Upgrade request to the server of httpSrv from a page at origin
+func webSocketStatus(t *testing.T, httpSrv *httptest.Server, origin string) int {
+	req, _ := http.NewRequest("GET", httpSrv.URL+RPCPath, nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	if origin != "" {
+		req.Header.Set("Origin", origin)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestWebSocketOrigin(t *testing.T) {
+	srv := NewServer()
+	srv.Register(new(EchoService))
+	httpSrv := httptest.NewServer(srv)
+	defer httpSrv.Close()
+	if status := webSocketStatus(t, httpSrv, "http://evil.example.com"); status != http.StatusForbidden {
+		t.Error("Request from another origin got", status)
+	}
+	if status := webSocketStatus(t, httpSrv, httpSrv.URL); status != http.StatusSwitchingProtocols {
+		t.Error("Request from the same origin got", status)
+	}
+	srv.SetOriginCheck(func(req *http.Request) bool {
+		return req.Header.Get("Origin") == "https://app.example.com"
+	})
+	if status := webSocketStatus(t, httpSrv, "https://app.example.com"); status != http.StatusSwitchingProtocols {
+		t.Error("Request from an allowed origin got", status)
+	}
+	if status := webSocketStatus(t, httpSrv, httpSrv.URL); status != http.StatusForbidden {
+		t.Error("Request from an origin the check refuses got", status)
+	}
+	//Clients that are not browsers send no origin
+	srv.SetOriginCheck(nil)
+	client, err := DialWebSocket("ws://" + httpSrv.Listener.Addr().String() + RPCPath)
+	if err != nil {
+		t.Fatal("dialing", err)
+	}
+	defer client.Close()
+	reply := ""
+	if err := client.Call("EchoService.Echo", "hi", &reply); err != nil || reply != "hi" {
+		t.Error("Echo failed", reply, err)
+	}
+}
+
+func TestWebSocketFrames(t *testing.T) {
+	clientSide, serverSide := net.Pipe()
+	client := newWebSocketConn(clientSide, bufio.NewReader(clientSide), true)
+	server := newWebSocketConn(serverSide, bufio.NewReader(serverSide), false)
+	go func() {
+		client.writeFrame(wsOpPing, []byte("ping"))
+		client.Write([]byte("hello "))
+		client.writeFrame(wsOpText, []byte("world"))
+	}()
+	data := make([]byte, 11)
+	pong := make(chan error, 1)
+	go func() {
+		//The pong is read by the client while the server reads the data
+		if err := client.nextFrame(); err != io.EOF {
+			pong <- err
+		}
+		close(pong)
+	}()
+	if _, err := io.ReadFull(server, data); err != nil || string(data) != "hello world" {
+		t.Fatal("Unexpected data", string(data), err)
+	}
+	server.Close()
+	if err := <-pong; err != nil {
+		t.Error("Client did not get the pong and the close", err)
+	}
+
+	//Servers refuse unmasked frames
+	clientSide, serverSide = net.Pipe()
+	server = newWebSocketConn(serverSide, bufio.NewReader(serverSide), false)
+	go func() {
+		unmasked := newWebSocketConn(clientSide, bufio.NewReader(clientSide), false)
+		unmasked.Write([]byte("data"))
+		io.Copy(io.Discard, clientSide)
+	}()
+	if _, err := server.Read(data); err == nil || !strings.Contains(err.Error(), "masking") {
+		t.Error("Expected a protocol error and got", err)
+	}
+}